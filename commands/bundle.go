@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"os"
+)
+
+// Creates and imports bundles, single-file archives of a fileset and its
+// files for moving data where remote storage can't be reached.
+func BundleCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage:", os.Args[0], "bundle (create [-base fileset_name] [-o file] fileset_name | import [-cache] [-remote=false] [-f] file)")
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		createBundle(args[1:])
+	case "import":
+		importBundle(args[1:])
+	default:
+		panic("Unsupported action for bundle command")
+	}
+}
+
+func createBundle(args []string) {
+	flagSet := flag.NewFlagSet("ekit bundle create fileset_name", flag.ExitOnError)
+	base := flagSet.String("base", "", "leave out files this fileset (or ref) also has")
+	output := flagSet.String("o", "", "file to write the bundle to (defaults to fileset_name.ekbundle)")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 1 {
+		fmt.Println("You need to specify the fileset to bundle.")
+		fmt.Println("Usage:", os.Args[0], "bundle create [-base fileset_name] [-o file] fileset_name")
+		return
+	}
+	filesetName := flagSet.Arg(0)
+	if *output == "" {
+		*output = filesetName + ".ekbundle"
+	}
+
+	ws := workspace.GetWorkspace(".")
+	ws.CreateBundle(filesetName, *base, *output)
+}
+
+func importBundle(args []string) {
+	flagSet := flag.NewFlagSet("ekit bundle import file", flag.ExitOnError)
+	toCache := flagSet.Bool("cache", false, "load the files into the local cache")
+	toRemote := flagSet.Bool("remote", true, "load the fileset and its files into remote storage")
+	force := flagSet.Bool("f", false, "overwrite the fileset if it already exists in remote storage")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 1 || !(*toCache || *toRemote) {
+		fmt.Println("You need to specify the bundle to import, and where to import it.")
+		fmt.Println("Usage:", os.Args[0], "bundle import [-cache] [-remote=false] [-f] file")
+		return
+	}
+
+	ws := workspace.GetWorkspace(".")
+	ws.ImportBundle(flagSet.Arg(0), *toCache, *toRemote, *force)
+}
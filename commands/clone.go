@@ -12,10 +12,11 @@ func CloneCommand(args []string) {
 
 	flagSet := flag.NewFlagSet("ekit clone workspace_name [fileset_name]", flag.ExitOnError)
 	patternString := flagSet.String("filters", "", "only pull down files matched against a set of path patterns")
+	applyTransferFlags := transferFlags(flagSet)
 
 	if len(args) < 1 {
 		fmt.Println("You need to specify the workspace you want to clone.")
-		fmt.Println("Usage:", os.Args[0], "clone workspace_name [fileset_name] [-addonly pattern1,pattern2,…,patternN]")
+		fmt.Println("Usage:", os.Args[0], "clone workspace_name [fileset_name] [-filters pattern1,pattern2,…,patternN]")
 		return
 	}
 
@@ -24,19 +25,35 @@ func CloneCommand(args []string) {
 		Name: wsName,
 	}
 
-	var fileSet string
-	var err error
+	// Flags may come before or after the optional fileset name
+	flagSet.Parse(args[1:])
+	fileSet := flagSet.Arg(0)
+	if flagSet.NArg() > 0 {
+		flagSet.Parse(flagSet.Args()[1:])
+	}
+	if flagSet.NArg() > 0 {
+		fmt.Println("Unexpected arguments:", strings.Join(flagSet.Args(), " "))
+		fmt.Println("Usage:", os.Args[0], "clone workspace_name [fileset_name] [-filters pattern1,pattern2,…,patternN]")
+		return
+	}
+	applyTransferFlags()
 
-	if len(args) >= 2 && args[1] != "-addonly" {
-		fileSet = args[1]
-		flagSet.Parse(args[2:])
-	} else {
-		flagSet.Parse(args[1:])
-		fileSet, err = ws.Remote().LatestFileset()
+	if fileSet == "" {
+		// Clone the workspace's default fileset if it has one, else the latest
+		info, err := ws.Remote().Info()
 		if err != nil {
-			fmt.Printf("Unable to determine latest fileset: %s\n", err)
+			fmt.Printf("Unable to read workspace metadata: %s\n", err)
 			return
 		}
+		if info != nil && info.DefaultFileset != "" {
+			fileSet = info.DefaultFileset
+		} else {
+			fileSet, err = ws.Remote().LatestFileset()
+			if err != nil {
+				fmt.Printf("Unable to determine latest fileset: %s\n", err)
+				return
+			}
+		}
 	}
 
 	var patterns []string
@@ -48,6 +65,6 @@ func CloneCommand(args []string) {
 	println("patternString", *patternString)
 
 	os.Mkdir(wsName, 0700)
-	ws.Init(wsName, true)
+	ws.Init(wsName, true, "")
 	ws.Pull(fileSet, patterns)
 }
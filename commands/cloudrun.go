@@ -19,7 +19,7 @@ func CloudRunCommand(args []string) {
 
 	flagSet := flag.NewFlagSet("ekit cloudrun [-fileset fileset] app cmd", flag.ExitOnError)
 
-	filesetFlag := flagSet.String("fileset", "", "fileset to use")
+	filesetFlag := flagSet.String("fileset", "", "fileset (or ref) to use")
 	flagSet.Parse(args)
 	leftoverArgs := args[len(args)-flagSet.NArg():]
 
@@ -35,7 +35,12 @@ func CloudRunCommand(args []string) {
 	if *filesetFlag == "" {
 		fileset = ws.GetCurrentFileSetName()
 	} else {
-		fileset = *filesetFlag
+		// Resolve refs now so the job is pinned to a specific fileset
+		var err error
+		fileset, err = ws.Remote().ResolveFileset(*filesetFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	app := leftoverArgs[0]
@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"os"
+	"strings"
+)
+
+// Writes a fileset into a plain directory, without creating a workspace
+func ExportCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit export fileset_name dir", flag.ExitOnError)
+	wsName := flagSet.String("workspace", "", "workspace to export from (defaults to the current one)")
+	patternString := flagSet.String("filters", "", "only export files matched against a set of path patterns")
+	applyTransferFlags := transferFlags(flagSet)
+	flagSet.Parse(args)
+	applyTransferFlags()
+
+	if flagSet.NArg() < 2 {
+		fmt.Println("You need to specify the fileset to export and the directory to export it to.")
+		fmt.Println("Usage:", os.Args[0], "export [-workspace workspace_name] [-filters pattern1,pattern2,…,patternN] fileset_name dir")
+		return
+	}
+
+	ws := workspace.GetWorkspace(".")
+	if *wsName != "" && *wsName != ws.Name {
+		ws = workspace.Workspace{Name: *wsName}
+	}
+	if ws.Name == "" {
+		fmt.Println("You need to specify a workspace with -workspace or run from within one.")
+		return
+	}
+
+	var patterns []string
+	if *patternString != "" {
+		patterns = strings.Split(*patternString, ",")
+	}
+	ws.Export(flagSet.Arg(0), patterns, flagSet.Arg(1))
+}
@@ -1,41 +1,128 @@
 package commands
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/opslabjpl/earthkit-cli/fileset"
 	"github.com/opslabjpl/earthkit-cli/workspace"
+	"github.com/opslabjpl/earthkit-cli/workspace/remote"
 	"log"
-	"path"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+// Lists a workspace's filesets with their details, from the summaries stored
+// beside them
 func FilesetsCommand(args []string) {
-	var wsName string
-	var ws *workspace.Workspace
+	flagSet := flag.NewFlagSet("ekit filesets [workspace_name]", flag.ExitOnError)
+	sortBy := flagSet.String("sort", "name", "sort by name, time, size or count")
+	since := flagSet.String("since", "", "only list filesets created since a date (2006-01-02 or RFC 3339) or for a duration (72h)")
+	jsonOutput := flagSet.Bool("json", false, "print the filesets as JSON")
+	storeSummaries := flagSet.Bool("store-summaries", false, "first store summaries for filesets pushed without them, so listing needn't fetch their manifests")
+	flagSet.Parse(args)
 
-	if len(args) >= 1 {
-		wsName = args[0]
-		ws = workspace.New(wsName, "")
+	var ws *workspace.Workspace
+	if flagSet.NArg() >= 1 {
+		ws = workspace.New(flagSet.Arg(0), "")
 	} else {
 		ws_ := workspace.GetWorkspace(".")
 		ws = &ws_
 	}
 
-	keys, err := ws.Remote().Filesets()
+	var cutoff time.Time
+	if *since != "" {
+		var err error
+		if cutoff, err = parseSince(*since); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var less func(a, b *remote.FilesetSummary) bool
+	switch *sortBy {
+	case "name":
+		less = func(a, b *remote.FilesetSummary) bool { return a.Name < b.Name }
+	case "time":
+		less = func(a, b *remote.FilesetSummary) bool { return a.CrTime.Before(b.CrTime) }
+	case "size":
+		less = func(a, b *remote.FilesetSummary) bool { return a.Size < b.Size }
+	case "count":
+		less = func(a, b *remote.FilesetSummary) bool { return a.Count < b.Count }
+	default:
+		fmt.Println("Unknown sort order", *sortBy)
+		fmt.Println("Usage:", os.Args[0], "filesets [-sort name|time|size|count] [-since date|duration] [-json] [-store-summaries] [workspace_name]")
+		return
+	}
+
+	if *storeSummaries {
+		stored, err := ws.Remote().StoreMissingSummaries()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !*jsonOutput {
+			fmt.Printf("Stored %d fileset summaries\n", stored)
+		}
+	}
+	all, err := ws.Remote().FilesetSummaries()
 	if err != nil {
 		log.Fatal(err)
 	}
+	summaries := make([]remote.FilesetSummary, 0, len(all))
+	for _, summary := range all {
+		if !summary.CrTime.Before(cutoff) {
+			summaries = append(summaries, summary)
+		}
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return less(&summaries[i], &summaries[j])
+	})
 
-	if len(keys) == 0 {
+	if *jsonOutput {
+		data, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if len(summaries) == 0 {
 		fmt.Println("No remote filesets found for workspace '" + ws.Name + "'.")
 		return
 	}
 
 	fmt.Printf("Remote filesets for '%s':\n", ws.Name)
-	for _, key := range keys {
-		fmt.Printf("  %s\n", strings.Replace(path.Base(key.Key), ".json.gz", "", 1))
+	width := len("NAME")
+	for _, summary := range summaries {
+		if len(summary.Name) > width {
+			width = len(summary.Name)
+		}
+	}
+	fmt.Printf("  %-*s  %-19s  %8s  %14s  %s\n", width, "NAME", "CREATED", "FILES", "BYTES", "COMMENT")
+	for _, summary := range summaries {
+		comment := summary.Comment
+		if summary.Parent != "" {
+			comment = fmt.Sprintf("(from %s) %s", summary.Parent, comment)
+		}
+		fmt.Printf("  %-*s  %-19s  %8d  %14d  %s\n", width, summary.Name, summary.CrTime.Local().Format("2006-01-02 15:04:05"), summary.Count, summary.Size, strings.TrimSpace(comment))
 	}
 }
 
+// Accepts a date, a date and time, or a duration back from now
+func parseSince(since string) (time.Time, error) {
+	if duration, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Unable to parse %q as a date (2006-01-02 or RFC 3339) or a duration (72h)", since)
+}
+
 func FilesetDeleteCommand(args []string) {
 	if len(args) < 1 {
 		fmt.Println("You need to specify a fileset")
@@ -45,3 +132,196 @@ func FilesetDeleteCommand(args []string) {
 	filesetName := args[0]
 	ws.DeleteFileset(filesetName)
 }
+
+// Shows what changed between two filesets, or between a fileset and the
+// working tree
+func FilesetDiffCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit fileset-diff old_fileset [new_fileset]", flag.ExitOnError)
+	jsonOutput := flagSet.Bool("json", false, "print the differences as JSON")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 1 {
+		fmt.Println("You need to specify the fileset to compare against.")
+		fmt.Println("Usage:", os.Args[0], "fileset-diff [-json] old_fileset [new_fileset]")
+		return
+	}
+	ws := workspace.GetWorkspace(".")
+	diff := ws.DiffFilesets(flagSet.Arg(0), flagSet.Arg(1))
+
+	if *jsonOutput {
+		data, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printDiff(diff)
+}
+
+func printDiff(diff *fileset.FileSetDiff) {
+	if len(diff.Added)+len(diff.Removed)+len(diff.Modified)+len(diff.Renamed)+len(diff.Copied) == 0 {
+		fmt.Println("No differences")
+		return
+	}
+	name := func(entry fileset.DiffEntry) string {
+		if entry.IsDir {
+			return entry.Path + "/"
+		}
+		return entry.Path
+	}
+	for _, entry := range diff.Renamed {
+		fmt.Printf("R  %s -> %s\n", entry.From, entry.Path)
+	}
+	for _, entry := range diff.Copied {
+		fmt.Printf("C  %s -> %s (%+d)\n", entry.From, entry.Path, entry.NewSize)
+	}
+	for _, entry := range diff.Added {
+		fmt.Printf("A  %s (%+d)\n", name(entry), entry.NewSize)
+	}
+	for _, entry := range diff.Removed {
+		fmt.Printf("D  %s (%+d)\n", name(entry), -entry.OldSize)
+	}
+	for _, entry := range diff.Modified {
+		fmt.Printf("M  %s [%s] (%+d)\n", name(entry), strings.Join(entry.Changes, ", "), entry.NewSize-entry.OldSize)
+	}
+	fmt.Println()
+	fmt.Println("Changes per directory (bytes added, removed, net):")
+	for _, dir := range diff.Dirs {
+		fmt.Printf("  %12d %12d %+13d  %s/\n", dir.Added, dir.Removed, dir.Delta, dir.Path)
+	}
+	fmt.Printf("%d renamed, %d copied, %d added, %d removed, %d modified; %+d bytes\n",
+		len(diff.Renamed), len(diff.Copied), len(diff.Added), len(diff.Removed), len(diff.Modified), diff.SizeDelta)
+}
+
+// Prints a fileset's details and its entries, either as a tree or as a long
+// listing, optionally limited to a subdirectory and to matching paths
+func FilesetShowCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit fileset-show fileset_name [path]", flag.ExitOnError)
+	long := flagSet.Bool("l", false, "print a long listing (mode, size, mtime, digest) instead of a tree")
+	wsName := flagSet.String("workspace", "", "workspace the fileset belongs to (defaults to the current one)")
+	patternString := flagSet.String("filters", "", "only show entries matched against a set of path patterns")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 1 {
+		fmt.Println("You need to specify a fileset.")
+		fmt.Println("Usage:", os.Args[0], "fileset-show [-l] [-workspace workspace_name] [-filters pattern1,pattern2,…,patternN] fileset_name [path]")
+		return
+	}
+
+	ws := workspace.GetWorkspace(".")
+	if *wsName != "" && *wsName != ws.Name {
+		ws = workspace.Workspace{Name: *wsName}
+	}
+	if ws.Name == "" {
+		fmt.Println("You need to specify a workspace with -workspace or run from within one.")
+		return
+	}
+
+	remoteWs := ws.Remote()
+	filesetName, err := remoteWs.ResolveFileset(flagSet.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileSet := remoteWs.GetFileset(filesetName)
+
+	fmt.Printf("fileset %s\n", filesetName)
+	if fileSet.Comment != "" {
+		fmt.Printf("Comment: %s\n", fileSet.Comment)
+	}
+	fmt.Printf("Date:    %s\n", fileSet.CrTime.Format("Mon Jan 2 15:04:05 2006 -0700"))
+	if fileSet.Author != "" || fileSet.Host != "" {
+		fmt.Printf("Author:  %s@%s\n", fileSet.Author, fileSet.Host)
+	}
+	if fileSet.Parent != "" {
+		fmt.Printf("Parent:  %s\n", fileSet.Parent)
+	}
+	fmt.Printf("Files:   %d (%d bytes)\n", fileSet.Count, fileSet.Size)
+	fmt.Println()
+
+	entryMap := fileSet.Root.Flatten()
+	var patterns []string
+	if *patternString != "" {
+		patterns = strings.Split(*patternString, ",")
+	}
+	entryMap = ws.Filter(entryMap, patterns)
+
+	// Keep only the entries under the requested path, relative to it
+	prefix := filepath.Clean(flagSet.Arg(1))
+	if prefix != "." {
+		subMap := make(fileset.EntryMap)
+		for entryPath, entry := range entryMap {
+			if entryPath == prefix {
+				if !entry.Mode.IsDir() {
+					subMap[filepath.Base(entryPath)] = entry
+				}
+			} else if strings.HasPrefix(entryPath, prefix+string(filepath.Separator)) {
+				subMap[entryPath[len(prefix)+1:]] = entry
+			}
+		}
+		if len(subMap) == 0 {
+			if _, ok := entryMap[prefix]; !ok {
+				log.Fatalf("%s is not in fileset %s", prefix, filesetName)
+			}
+		}
+		entryMap = subMap
+	}
+
+	paths := sortedEntryPaths(entryMap)
+	for _, entryPath := range paths {
+		entry := entryMap[entryPath]
+		if *long {
+			printLongEntry(entryPath, entry)
+		} else {
+			printTreeEntry(entryPath, entry)
+		}
+	}
+}
+
+// Sorts paths component by component, so that each directory is immediately
+// followed by its contents
+func sortedEntryPaths(entryMap fileset.EntryMap) []string {
+	paths := make([]string, 0, len(entryMap))
+	for entryPath := range entryMap {
+		paths = append(paths, entryPath)
+	}
+	sep := string(filepath.Separator)
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := strings.Split(paths[i], sep), strings.Split(paths[j], sep)
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return paths
+}
+
+func printLongEntry(entryPath string, entry *fileset.Entry) {
+	digest := entry.Digest
+	if digest == "" {
+		digest = "-"
+	}
+	name := entryPath
+	if entry.Mode.IsDir() {
+		name += "/"
+	} else if entry.Mode&os.ModeSymlink != 0 {
+		name += " -> " + entry.Target
+	}
+	fmt.Printf("%s %12d %s %-64s %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04:05"), digest, name)
+}
+
+func printTreeEntry(entryPath string, entry *fileset.Entry) {
+	depth := strings.Count(entryPath, string(filepath.Separator))
+	indent := strings.Repeat("    ", depth)
+	name := filepath.Base(entryPath)
+	switch {
+	case entry.Mode.IsDir():
+		fmt.Printf("%s%s/\n", indent, name)
+	case entry.Mode&os.ModeSymlink != 0:
+		fmt.Printf("%s%s -> %s\n", indent, name, entry.Target)
+	default:
+		fmt.Printf("%s%s (%d bytes)\n", indent, name, entry.Size)
+	}
+}
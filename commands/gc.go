@@ -0,0 +1,44 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"log"
+	"strings"
+	"time"
+)
+
+// Deletes blobs in the remote workspace that no fileset references.
+func GCCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit gc", flag.ExitOnError)
+	dryRun := flagSet.Bool("n", false, "dry run: only report what would be deleted")
+	grace := flagSet.Duration("grace", 24*time.Hour, "keep unreferenced blobs modified more recently than this")
+	flagSet.Parse(args)
+
+	ws := workspace.GetWorkspace(".")
+	report, err := ws.Remote().GC(*grace, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%d filesets reference %d of %d blobs\n", report.Filesets, report.Referenced, report.Blobs)
+	if len(report.DanglingRefs) > 0 {
+		fmt.Printf("Warning: refs pointing at missing filesets: %s\n", strings.Join(report.DanglingRefs, ", "))
+	}
+	if report.TooRecent > 0 {
+		fmt.Printf("Keeping %d unreferenced blobs newer than %s\n", report.TooRecent, *grace)
+	}
+	if *dryRun {
+		fmt.Printf("Would delete %d blobs, reclaiming %d bytes\n", report.Unreferenced-report.TooRecent, report.Reclaimable)
+	} else {
+		fmt.Printf("Deleted %d blobs, reclaiming %d bytes\n", report.Deleted, report.DeletedBytes)
+	}
+	if report.StoreRefsDropped > 0 || report.StoreReclaimable > 0 {
+		if *dryRun {
+			fmt.Printf("Shared store: would drop %d references, reclaiming %d bytes\n", report.StoreRefsDropped, report.StoreReclaimable)
+		} else {
+			fmt.Printf("Shared store: dropped %d references, deleted %d blobs, reclaiming %d bytes\n", report.StoreRefsDropped, report.StoreDeleted, report.StoreDeletedBytes)
+		}
+	}
+}
@@ -1,27 +1,34 @@
 package commands
 
 import (
+	"flag"
 	"fmt"
 	"github.com/opslabjpl/earthkit-cli/workspace"
 	"os"
+	"strings"
 )
 
 func InitCommand(args []string) {
 	if len(args) < 1 {
 		fmt.Println("You need to specify a name for the workspace.")
-		fmt.Println("Usage:", os.Args[0], "init workspace_name [dir]")
+		fmt.Println("Usage:", os.Args[0], "init workspace_name [dir] [-d \"description\"]")
 		return
 	}
 
 	wsName := args[0]
 	dir := "."
 
-	if len(args) >= 2 {
+	flagSet := flag.NewFlagSet("ekit init workspace_name [dir]", flag.ExitOnError)
+	description := flagSet.String("d", "", "description of the workspace")
+	if len(args) >= 2 && !strings.HasPrefix(args[1], "-") {
 		dir = args[1]
+		flagSet.Parse(args[2:])
+	} else {
+		flagSet.Parse(args[1:])
 	}
 
 	ws := workspace.Workspace{
 		Name: wsName,
 	}
-	ws.Init(dir, false)
+	ws.Init(dir, false, *description)
 }
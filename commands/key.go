@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"log"
+	"os"
+)
+
+// Manages client-side encryption of the current workspace's remote data
+func KeyCommand(args []string) {
+	var action string
+
+	if len(args) < 1 {
+		action = "status"
+	} else {
+		action = args[0]
+		args = args[1:]
+	}
+
+	ws := workspace.GetWorkspace(".")
+	remoteWs := ws.Remote()
+
+	flagSet := flag.NewFlagSet("ekit key "+action, flag.ExitOnError)
+	keyFile := flagSet.String("key-file", "", "key file to use (generated if it does not exist); prompts for a passphrase if not given")
+
+	switch action {
+	case "status":
+		if remoteWs.Encrypted() {
+			fmt.Printf("Workspace '%s' is encrypted with key %s.\n", ws.Name, remoteWs.KeyID())
+		} else {
+			fmt.Printf("Workspace '%s' is not encrypted.\n", ws.Name)
+		}
+	case "init":
+		flagSet.Parse(args)
+		if err := remoteWs.EnableEncryption(*keyFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Workspace '%s' is now encrypted with key %s.\n", ws.Name, remoteWs.KeyID())
+		if *keyFile != "" {
+			fmt.Println("Set encryption_key_file =", *keyFile, "in $HOME/.earthkitrc to use it.")
+		}
+	case "rotate":
+		flagSet.Parse(args)
+		if err := remoteWs.RotateKey(*keyFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Workspace '%s' is now encrypted with key %s.\n", ws.Name, remoteWs.KeyID())
+		if *keyFile != "" {
+			fmt.Println("Set encryption_key_file =", *keyFile, "in $HOME/.earthkitrc to use it.")
+		}
+	default:
+		fmt.Println("Usage:", os.Args[0], "key (status | init [-key-file path] | rotate [-key-file path])")
+	}
+}
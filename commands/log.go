@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Walks the chain of parent filesets, starting at the given fileset (or ref)
+// or at the current fileset, printing each one's details.
+func LogCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit log [fileset_name]", flag.ExitOnError)
+	max := flagSet.Int("n", 0, "only show this many filesets (0 shows the whole history)")
+	flagSet.Parse(args)
+
+	ws := workspace.GetWorkspace(".")
+	remoteWs := ws.Remote()
+
+	var filesetName string
+	if flagSet.NArg() >= 1 {
+		var err error
+		filesetName, err = remoteWs.ResolveFileset(flagSet.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if _, err := os.Lstat(filepath.Join(ws.FilesetsDir(), "_current")); err == nil {
+		filesetName = ws.GetCurrentFileSetName()
+	} else {
+		fmt.Println("You need to specify a fileset; this workspace has not been pushed or pulled yet.")
+		fmt.Println("Usage:", os.Args[0], "log [-n count] [fileset_name]")
+		return
+	}
+
+	visited := make(map[string]bool)
+	for i := 0; filesetName != "" && (*max <= 0 || i < *max); i++ {
+		if visited[filesetName] {
+			fmt.Printf("(history loops back to %s)\n", filesetName)
+			return
+		}
+		visited[filesetName] = true
+
+		data, err := remoteWs.GetFilesetData(filesetName)
+		if err != nil {
+			fmt.Printf("fileset %s\n    (no longer available: %s)\n", filesetName, err)
+			return
+		}
+		fileSet, err := fileset.LoadGzJson(data)
+		if err != nil {
+			log.Fatal("Unable to parse remote fileset")
+		}
+		printLogEntry(filesetName, fileSet)
+		filesetName = fileSet.Parent
+	}
+}
+
+func printLogEntry(name string, fileSet *fileset.FileSet) {
+	fmt.Printf("fileset %s\n", name)
+	if fileSet.Author != "" || fileSet.Host != "" {
+		fmt.Printf("Author: %s@%s\n", fileSet.Author, fileSet.Host)
+	}
+	fmt.Printf("Date:   %s\n", fileSet.CrTime.Format("Mon Jan 2 15:04:05 2006 -0700"))
+	fmt.Printf("Files:  %d (%d bytes)\n", fileSet.Count, fileSet.Size)
+	if fileSet.Comment != "" {
+		fmt.Printf("\n    %s\n", fileSet.Comment)
+	}
+	fmt.Println()
+}
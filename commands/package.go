@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"flag"
+	"github.com/opslabjpl/earthkit-cli/config"
+)
+
+// Adds flags overriding the transfer options of .earthkitrc to a command's
+// flag set.  The returned function must be called after parsing the flags,
+// before the workspace's remote is first used.
+func transferFlags(flagSet *flag.FlagSet) (apply func()) {
+	transfers := flagSet.Int("transfers", *config.TRANSFERS, "number of files to transfer concurrently")
+	partSize := flagSet.Int64("part-size", *config.PART_SIZE, "size (in bytes) of the parts large files are uploaded in")
+	bwlimit := flagSet.Int64("bwlimit", -1, "maximum combined transfer rate in bytes per second, 0 for unlimited (defaults to upload_limit/download_limit)")
+	return func() {
+		*config.TRANSFERS = *transfers
+		*config.PART_SIZE = *partSize
+		if *bwlimit >= 0 {
+			*config.UPLOAD_LIMIT = *bwlimit
+			*config.DOWNLOAD_LIMIT = *bwlimit
+		}
+	}
+}
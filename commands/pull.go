@@ -18,7 +18,9 @@ func PullCommand(args []string) {
 
 	flagSet := flag.NewFlagSet("ekit pull fileset_name", flag.ExitOnError)
 	patternString := flagSet.String("filters", "", "only pull down files matched against a set of path patterns")
+	applyTransferFlags := transferFlags(flagSet)
 	flagSet.Parse(args[1:])
+	applyTransferFlags()
 
 	var patterns []string
 	if *patternString != "" {
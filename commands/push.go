@@ -3,9 +3,11 @@ package commands
 import (
 	"flag"
 	"fmt"
-	"strings"
 	"github.com/opslabjpl/earthkit-cli/workspace"
+	"github.com/opslabjpl/earthkit-cli/workspace/remote"
 	"github.com/opslabjpl/goamz/aws"
+	"log"
+	"strings"
 )
 
 // TODO: make these configurable
@@ -17,16 +19,24 @@ func PushCommand(args []string) {
 
 	if len(args) < 1 {
 		fmt.Println("You need to specify a name for the fileset.")
-		fmt.Println("Usage: ekit push fileset_name [-c \"some helpful comment\"] [-filters \"pattern1,pattern2,…,patternN\"]")
+		fmt.Println("Usage: ekit push fileset_name [-c \"some helpful comment\"] [-filters \"pattern1,pattern2,…,patternN\"] [-ref ref_name] [-f | -rebase]")
 		return
 	}
 
 	filesetName := args[0]
+	if err := remote.CheckFilesetName(filesetName); err != nil {
+		log.Fatal(err)
+	}
 
 	flagSet := flag.NewFlagSet("ekit push fileset_name", flag.ExitOnError)
 	comment := flagSet.String("c", "", "Comment to give to the fileset")
-	patternString  := flagSet.String("filters", "", "upload only files from workspace that match given path patterns")
+	patternString := flagSet.String("filters", "", "upload only files from workspace that match given path patterns")
+	ref := flagSet.String("ref", "", "create or move the named ref to point at the pushed fileset")
+	force := flagSet.Bool("f", false, "overwrite an existing fileset, and push even if others have pushed since this workspace's fileset")
+	rebase := flagSet.Bool("rebase", false, "if others have pushed since this workspace's fileset, apply our changes on top of the latest fileset")
+	applyTransferFlags := transferFlags(flagSet)
 	flagSet.Parse(args[1:])
+	applyTransferFlags()
 
 	ws := workspace.GetWorkspace(".")
 
@@ -35,5 +45,12 @@ func PushCommand(args []string) {
 		patterns = strings.Split(*patternString, ",")
 	}
 
-	ws.Push(filesetName, *comment, patterns)
+	ws.Push(filesetName, *comment, patterns, *force, *rebase)
+
+	if *ref != "" {
+		if err := ws.Remote().PutRef(*ref, filesetName); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s -> %s\n", *ref, filesetName)
+	}
 }
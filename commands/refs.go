@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"log"
+	"os"
+	"sort"
+)
+
+// Manages named refs (e.g. "stable") pointing at the remote filesets of the
+// current workspace.  Refs are accepted anywhere a fileset name is.
+func RefCommand(args []string) {
+	var action string
+
+	if len(args) < 1 {
+		action = "list"
+	} else {
+		action = args[0]
+	}
+
+	ws := workspace.GetWorkspace(".")
+	remoteWs := ws.Remote()
+
+	switch action {
+	case "list":
+		refs, err := remoteWs.Refs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(refs) == 0 {
+			fmt.Println("No refs found for workspace '" + ws.Name + "'.")
+			return
+		}
+		names := make([]string, 0, len(refs))
+		for name, _ := range refs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("Refs for '%s':\n", ws.Name)
+		for _, name := range names {
+			fmt.Printf("  %s -> %s\n", name, refs[name])
+		}
+	case "create", "move":
+		if len(args) < 3 {
+			fmt.Println("Usage:", os.Args[0], "ref", action, "ref_name fileset_name")
+			return
+		}
+		ref, target := args[1], args[2]
+		current, err := remoteWs.GetRef(ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if action == "create" && current != "" {
+			log.Fatalf("Ref %s already exists (-> %s). Use 'ref move' to change it.", ref, current)
+		}
+		if action == "move" && current == "" {
+			log.Fatalf("Ref %s does not exist. Use 'ref create' to create it.", ref)
+		}
+		// Allow pointing a ref at whatever another ref currently points at
+		target, err = remoteWs.ResolveFileset(target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = remoteWs.PutRef(ref, target); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s -> %s\n", ref, target)
+	case "delete":
+		if len(args) < 2 {
+			fmt.Println("Usage:", os.Args[0], "ref delete ref_name")
+			return
+		}
+		current, err := remoteWs.GetRef(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if current == "" {
+			log.Fatalf("Ref %s does not exist.", args[1])
+		}
+		if err = remoteWs.DeleteRef(args[1]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Println("Usage:", os.Args[0], "ref (list | create ref_name fileset_name | move ref_name fileset_name | delete ref_name)")
+	}
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"os"
+)
+
+// Serves a fileset over HTTP, fetching files from remote storage on demand
+func ServeCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit serve fileset_name", flag.ExitOnError)
+	addr := flagSet.String("addr", "localhost:8080", "address to listen on (use :8080 to accept connections from other machines)")
+	wsName := flagSet.String("workspace", "", "workspace to serve from (defaults to the current one)")
+	cacheDir := flagSet.String("cache", "", "directory to cache fetched files in")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() < 1 {
+		fmt.Println("You need to specify the fileset to serve.")
+		fmt.Println("Usage:", os.Args[0], "serve [-addr host:port] [-workspace workspace_name] [-cache dir] fileset_name")
+		return
+	}
+
+	ws := workspace.GetWorkspace(".")
+	if *wsName != "" && *wsName != ws.Name {
+		ws = workspace.Workspace{Name: *wsName}
+	}
+	if ws.Name == "" {
+		fmt.Println("You need to specify a workspace with -workspace or run from within one.")
+		return
+	}
+	ws.Serve(flagSet.Arg(0), *addr, *cacheDir)
+}
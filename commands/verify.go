@@ -0,0 +1,25 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/workspace"
+	"os"
+)
+
+// Checks the integrity of the local cache and, optionally, of the remote
+// files of a fileset.  Exits non-zero if any problems remain.
+func VerifyCommand(args []string) {
+	flagSet := flag.NewFlagSet("ekit verify", flag.ExitOnError)
+	filesetName := flagSet.String("fileset", "", "also verify the remote files of this fileset (or ref)")
+	repair := flagSet.Bool("repair", false, "replace corrupt or missing files from a good copy")
+	flagSet.Parse(args)
+
+	ws := workspace.GetWorkspace(".")
+	problems := ws.Verify(*filesetName, *repair)
+	if problems > 0 {
+		fmt.Printf("%d problems found\n", problems)
+		os.Exit(1)
+	}
+	fmt.Println("No problems found")
+}
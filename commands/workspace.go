@@ -1,17 +1,21 @@
 package commands
 
 import (
+	"flag"
 	"fmt"
 	"github.com/opslabjpl/earthkit-cli/config"
 	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/storage"
 	"github.com/opslabjpl/earthkit-cli/workspace"
 	"github.com/opslabjpl/earthkit-cli/workspace/remote"
-	"github.com/opslabjpl/goamz/s3"
+	"github.com/opslabjpl/goamz/aws"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 func WorkspaceCommand(args []string) {
@@ -28,17 +32,21 @@ func WorkspaceCommand(args []string) {
 		listRemoteWorkspaces()
 	case "status":
 		localWorkspaceStatus()
+	case "migrate":
+		migrateWorkspace(args[1:])
+	case "info":
+		workspaceInfo(args[1:])
+	case "delete":
+		deleteWorkspace(args[1:])
+	case "copy":
+		copyWorkspace(args[1:])
 	default:
 		panic("Unsupported action for workspace command")
 	}
 }
 
 func listRemoteWorkspaces() {
-	auth := config.AWSAuth()
-	myS3 := s3.New(auth, config.Region)
-	bucket := myS3.Bucket(*config.S3_BUCKET)
-
-	workspaces, err := remote.Workspaces(bucket)
+	workspaces, err := remote.Workspaces(storage.New(), remote.DefaultLayout())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -54,6 +62,271 @@ func listRemoteWorkspaces() {
 	}
 }
 
+// Moves a workspace's filesets and files from one key prefix to another, e.g.
+// from the historical ".earthkit" prefix to the configured s3_key_prefix.
+func migrateWorkspace(args []string) {
+	flagSet := flag.NewFlagSet("ekit workspace migrate [workspace_name]", flag.ExitOnError)
+	from := flagSet.String("from", ".earthkit", "key prefix the workspace is currently stored under")
+	to := flagSet.String("to", *config.S3_KEY_PREFIX, "key prefix to move the workspace to")
+	flagSet.Parse(args)
+
+	var wsName string
+	if flagSet.NArg() >= 1 {
+		wsName = flagSet.Arg(0)
+	} else {
+		wsName = workspace.GetWorkspace(".").Name
+	}
+	if wsName == "" {
+		fmt.Println("You need to specify a workspace or run from within one.")
+		fmt.Println("Usage:", os.Args[0], "workspace migrate [-from prefix] [-to prefix] [workspace_name]")
+		return
+	}
+
+	src := remote.New(wsName, storage.New(), remote.NewLayout(*from))
+	if !src.Exists() {
+		log.Fatalf("Workspace %s does not exist under %s", wsName, src.Layout().Root())
+	}
+	_, err := src.Migrate(remote.NewLayout(*to))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Workspace", wsName, "migrated.")
+}
+
+// Returns the remote workspace named by the first argument, or by the
+// workspace the current directory is in
+func namedRemoteWorkspace(flagSet *flag.FlagSet) *remote.Remote {
+	var wsName string
+	if flagSet.NArg() >= 1 {
+		wsName = flagSet.Arg(0)
+	} else {
+		wsName = workspace.GetWorkspace(".").Name
+	}
+	if wsName == "" {
+		return nil
+	}
+	return remote.New(wsName, storage.New(), remote.DefaultLayout())
+}
+
+// Shows a workspace's metadata and a summary of its contents, after applying
+// any changes given by the flags.
+func workspaceInfo(args []string) {
+	flagSet := flag.NewFlagSet("ekit workspace info [workspace_name]", flag.ExitOnError)
+	description := flagSet.String("d", "", "set the description (-d \"\" clears it)")
+	defaultFileset := flagSet.String("default", "", "set the fileset (or ref) cloned by default (-default \"\" clears it)")
+	settings := flagSet.String("set", "", "set comma separated key=value settings (an empty value removes the setting)")
+	flagSet.Parse(args)
+
+	remoteWs := namedRemoteWorkspace(flagSet)
+	if remoteWs == nil {
+		fmt.Println("You need to specify a workspace or run from within one.")
+		fmt.Println("Usage:", os.Args[0], "workspace info [-d description] [-default fileset_name] [-set key=value,...] [workspace_name]")
+		return
+	}
+	if !remoteWs.Exists() {
+		log.Fatalf("Workspace %s does not exist.", remoteWs.Name())
+	}
+	info, err := remoteWs.Info()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Flags given empty values clear what they set
+	given := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if len(given) > 0 {
+		if info == nil {
+			info = new(remote.WorkspaceInfo)
+		}
+		if given["d"] {
+			info.Description = *description
+		}
+		if given["default"] {
+			if *defaultFileset != "" {
+				if _, err := remoteWs.ResolveFileset(*defaultFileset); err != nil {
+					log.Fatal(err)
+				}
+			}
+			info.DefaultFileset = *defaultFileset
+		}
+		if *settings != "" {
+			if info.Settings == nil {
+				info.Settings = make(map[string]string)
+			}
+			for _, setting := range strings.Split(*settings, ",") {
+				kv := strings.SplitN(setting, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					log.Fatalf("Invalid setting %q, expected key=value", setting)
+				}
+				if kv[1] == "" {
+					delete(info.Settings, kv[0])
+				} else {
+					info.Settings[kv[0]] = kv[1]
+				}
+			}
+		}
+		if err = remoteWs.PutInfo(info); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println("Workspace:      ", remoteWs.Name())
+	if info == nil {
+		fmt.Println("(no metadata recorded)")
+	} else {
+		fmt.Println("Description:    ", info.Description)
+		fmt.Println("Owner:          ", info.Owner)
+		if info.Created.IsZero() {
+			fmt.Println("Created:         unknown")
+		} else {
+			fmt.Println("Created:        ", info.Created.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		}
+		fmt.Println("Default fileset:", info.DefaultFileset)
+		if len(info.Settings) > 0 {
+			keys := make([]string, 0, len(info.Settings))
+			for k, _ := range info.Settings {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Println("Settings:")
+			for _, k := range keys {
+				fmt.Printf("  %s = %s\n", k, info.Settings[k])
+			}
+		}
+	}
+
+	filesets, err := remoteWs.Filesets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	latest, err := remoteWs.LatestFileset()
+	if err != nil {
+		log.Fatal(err)
+	}
+	refs, err := remoteWs.Refs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Filesets:        %d (latest: %s)\n", len(filesets), latest)
+	fmt.Printf("Refs:            %d\n", len(refs))
+	if remoteWs.Encrypted() {
+		fmt.Printf("Encrypted:       yes (key %s)\n", remoteWs.KeyID())
+	} else {
+		fmt.Println("Encrypted:       no")
+	}
+}
+
+// Deletes a remote workspace with all its filesets and files.  The local
+// copy, if any, is left alone.
+func deleteWorkspace(args []string) {
+	flagSet := flag.NewFlagSet("ekit workspace delete workspace_name", flag.ExitOnError)
+	yes := flagSet.Bool("y", false, "don't ask for confirmation")
+	flagSet.Parse(args)
+
+	// Deleting is too drastic to infer the workspace from the current directory
+	if flagSet.NArg() < 1 {
+		fmt.Println("You need to specify the workspace to delete.")
+		fmt.Println("Usage:", os.Args[0], "workspace delete [-y] workspace_name")
+		return
+	}
+	remoteWs := namedRemoteWorkspace(flagSet)
+	if !remoteWs.Exists() {
+		log.Fatalf("Workspace %s does not exist.", remoteWs.Name())
+	}
+
+	filesets, err := remoteWs.Filesets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := remoteWs.Files()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Workspace %s has %d filesets and %d files.\n", remoteWs.Name(), len(filesets), len(files))
+	if !*yes {
+		var input string
+		fmt.Print("Type the workspace name to delete it permanently: ")
+		fmt.Scanf("%s", &input)
+		if input != remoteWs.Name() {
+			fmt.Println("Not deleted.")
+			return
+		}
+	}
+	if err = remoteWs.Delete(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Workspace", remoteWs.Name(), "deleted.")
+}
+
+// Environment variables holding the credentials used for the destination of
+// a workspace copy, when it is in another account
+const (
+	destAccessKeyEnv = "EARTHKIT_DEST_AWS_ACCESS_KEY"
+	destSecretKeyEnv = "EARTHKIT_DEST_AWS_SECRET_KEY"
+)
+
+// Copies a workspace to another bucket, prefix or region, e.g. to migrate it
+// to a new account, optionally deleting the original once the copy has been
+// verified.
+func copyWorkspace(args []string) {
+	flagSet := flag.NewFlagSet("ekit workspace copy [workspace_name]", flag.ExitOnError)
+	bucket := flagSet.String("bucket", *config.S3_BUCKET, "S3 bucket to copy the workspace to")
+	prefix := flagSet.String("prefix", *config.S3_KEY_PREFIX, "key prefix to copy the workspace to")
+	region := flagSet.String("region", *config.AWS_REGION, "AWS region of the destination bucket")
+	dir := flagSet.String("dir", "", "copy to local storage rooted at this directory instead of S3")
+	move := flagSet.Bool("move", false, "delete the workspace from its current location once copied")
+	applyTransferFlags := transferFlags(flagSet)
+	flagSet.Parse(args)
+	applyTransferFlags()
+
+	src := namedRemoteWorkspace(flagSet)
+	if src == nil {
+		fmt.Println("You need to specify a workspace or run from within one.")
+		fmt.Println("Usage:", os.Args[0], "workspace copy [-bucket bucket] [-prefix prefix] [-region region] [-dir dir] [-move] [workspace_name]")
+		return
+	}
+	if !src.Exists() {
+		log.Fatalf("Workspace %s does not exist.", src.Name())
+	}
+
+	var dstStorage storage.Storage
+	var dstDescription string
+	if *dir != "" {
+		if *config.STORAGE == "local" && filepath.Clean(*dir) == filepath.Clean(*config.STORAGE_DIR) &&
+			remote.NewLayout(*prefix).Root() == src.Layout().Root() {
+			log.Fatal("The destination is the workspace's current location")
+		}
+		dstStorage = storage.NewLocal(*dir)
+		dstDescription = *dir
+	} else {
+		if *config.STORAGE == "s3" && *bucket == *config.S3_BUCKET && *region == *config.AWS_REGION &&
+			remote.NewLayout(*prefix).Root() == src.Layout().Root() {
+			log.Fatal("The destination is the workspace's current location")
+		}
+		auth := config.AWSAuth()
+		if accessKey := os.Getenv(destAccessKeyEnv); accessKey != "" {
+			auth = aws.Auth{AccessKey: accessKey, SecretKey: os.Getenv(destSecretKeyEnv)}
+		}
+		dstStorage = storage.NewS3Bucket(*bucket, *region, auth)
+		dstDescription = fmt.Sprintf("s3://%s (%s)", *bucket, *region)
+	}
+	dst := remote.New(src.Name(), dstStorage, remote.NewLayout(*prefix))
+
+	copyTo := src.CopyTo
+	if *move {
+		copyTo = src.MoveTo
+	}
+	report, err := copyTo(dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Copied %d filesets and %d files (%d already present) to %s under %s\n",
+		report.Filesets, report.Copied, report.Skipped, dstDescription, dst.WorkspacePrefix())
+	if *move {
+		fmt.Println("Workspace", src.Name(), "deleted from its old location.")
+	}
+}
+
 func localWorkspaceStatus() {
 	ws := workspace.GetWorkspace(".")
 	fmt.Println("Current workspace:", ws.Name)
@@ -80,7 +353,7 @@ func localWorkspaceStatus() {
 	}
 
 	baseDir := ws.LocalRootDir
-	builderCfg := fileset.BuilderCfg{baseDir, false, true, []string{workspace.EarthkitDir}}
+	builderCfg := fileset.BuilderCfg{baseDir, false, true, ws.IgnorePatterns()}
 	result := fileset.Build(builderCfg, nil, nil)
 	localFileSet := result.FileSet()
 	diff := cachedFileSet.Root.Flatten().Diff(localFileSet.Root.Flatten())
@@ -2,10 +2,13 @@ package config
 
 import (
 	"flag"
-	"github.com/rakyll/globalconf"
 	"github.com/opslabjpl/goamz/aws"
+	"github.com/opslabjpl/goamz/s3"
+	"github.com/rakyll/globalconf"
+	"log"
+	"net/url"
 	"os"
-	"path"
+	"strings"
 	"time"
 )
 
@@ -19,20 +22,86 @@ var AWS_ACCESS_KEY = flag.String("aws_access_key", "todo", "AWS ACCESS KEY to us
 var AWS_SECRET_KEY = flag.String("aws_secret_key", "todo", "AWS SECRET KEY to use")
 var S3_BUCKET = flag.String("s3_bucket", "earthkit-cli", "S3 bucket to use")
 var S3_KEY_PREFIX = flag.String("s3_key_prefix", ".earthkit", "S3 key prefix to use")
+var STORAGE = flag.String("storage", "s3", "Storage backend for remote workspaces (s3 or local)")
+var STORAGE_DIR = flag.String("storage_dir", "", "Root directory used by the local storage backend (e.g. an NFS mount)")
 var AWS_REGION = flag.String("aws_region", "us-gov-west-1", "AWS Region to use")
+var S3_ENDPOINT = flag.String("s3_endpoint", "", "URL of an S3-compatible endpoint (e.g. MinIO or Ceph) to use instead of AWS")
+var S3_PATH_STYLE = flag.Bool("s3_path_style", false, "Address buckets by path (endpoint/bucket/key) instead of by virtual host")
+var S3_SIGNATURE = flag.String("s3_signature", "v2", "Signature version used for S3 requests (v2 or v4)")
 var DOCKER_REGISTRY = flag.String("docker_registry", "", "Docker registry to use")
 var ETCDQ_S3_PATH = flag.String("etcdq_s3_path", "bin/ubuntu/etcdq", "S3 path to etcdq binary")
 var DOCKER_CONF_S3_PATH = flag.String("docker_conf_s3_path", "conf/docker.conf", "S3 path to docker conf file")
 var DOCKER_INSTALL_S3_PATH = flag.String("docker_install_s3_path", "bin/get.docker.io.sh", "S3 path to script for isntall docker")
 var DATA_DIR = flag.String("data_dir", "/mnt/data/earthkit", "Directory to mount EBS volume to for cloud processing")
+var CHUNKING = flag.Bool("chunking", false, "Store large files as content-defined chunks so that pushing a modified file only uploads the changed chunks")
+var COMPRESSION = flag.String("compression", "none", "Compression applied to files when pushing (none, gzip or zstd)")
+var COMPRESSION_SKIP = flag.String("compression_skip", ".gz,.tgz,.bz2,.xz,.zst,.zip,.7z,.tif,.tiff,.jpg,.jpeg,.png,.gif,.jp2", "Comma separated extensions of already compressed files, which are pushed uncompressed")
+var ENCRYPTION_KEY_FILE = flag.String("encryption_key_file", "", "Key file for workspaces encrypted with a key file (passphrase encrypted workspaces read EARTHKIT_PASSPHRASE or prompt)")
+var TRANSFERS = flag.Int("transfers", 32, "Number of files transferred concurrently by push and pull")
+var PART_SIZE = flag.Int64("part_size", 5242880, "Size (in bytes) of the parts large files are uploaded in; S3 requires at least 5 MiB")
+var UPLOAD_LIMIT = flag.Int64("upload_limit", 0, "Maximum combined upload rate (in bytes per second) of all transfers, 0 for unlimited")
+var DOWNLOAD_LIMIT = flag.Int64("download_limit", 0, "Maximum combined download rate (in bytes per second) of all transfers, 0 for unlimited")
+var INVENTORY_TTL = flag.Duration("inventory_ttl", time.Hour, "How long push trusts its cached list of the files already in a remote workspace")
+var SHARED_STORE = flag.Bool("shared_store", false, "Push files to a content store shared by all workspaces under s3_key_prefix, so that identical files are stored once (encrypted workspaces keep their own files)")
+var IGNORE_FILE = flag.String("ignore_file", "", "File of patterns left out of the filesets of every workspace, in .earthkitignore syntax (defaults to $HOME/.earthkitignore)")
 var CACHE_LIMIT = flag.Int64("cache_limit", 5368709120, "Cache limit (in bytes)")
 var EKIT_IMG = flag.String("earthkit_img", "earthkit-cli", "Docker image containing earhtkit-cli command")
 var Verbose = flag.Bool("v", false, "enables verbose output")
 var Region aws.Region = aws.Regions[*AWS_REGION]
 
-func WorkspacePrefix(workspace string) string {
-	return path.Join(*S3_KEY_PREFIX, workspace)
-	// return path.Join(S3KeyPrefix, workspace)
+// Returns the region to use for S3 requests.  If s3_endpoint is set, the
+// region is rewritten to point at that endpoint instead of AWS.
+func S3Region() aws.Region {
+	region := Region
+	if region.Name == "" {
+		region.Name = *AWS_REGION
+	}
+	return customizeS3Region(region)
+}
+
+// Like S3Region, but for the named region rather than aws_region
+func S3RegionNamed(name string) aws.Region {
+	region, ok := aws.Regions[name]
+	if !ok {
+		log.Fatalf("Unknown AWS region: %s", name)
+	}
+	return customizeS3Region(region)
+}
+
+func customizeS3Region(region aws.Region) aws.Region {
+	if *S3_ENDPOINT != "" {
+		endpoint, err := url.Parse(strings.TrimSuffix(*S3_ENDPOINT, "/"))
+		if err != nil || endpoint.Host == "" {
+			log.Fatalf("Invalid s3_endpoint: %s", *S3_ENDPOINT)
+		}
+		region.S3Endpoint = endpoint.String()
+		region.S3BucketEndpoint = endpoint.Scheme + "://${bucket}." + endpoint.Host
+		region.S3LocationConstraint = false
+	}
+	// goamz falls back to path-style addressing when there is no bucket endpoint
+	if *S3_PATH_STYLE {
+		region.S3BucketEndpoint = ""
+	}
+	return region
+}
+
+// Returns an S3 client honoring the endpoint, addressing and signature options
+func S3() *s3.S3 {
+	return S3With(AWSAuth(), S3Region())
+}
+
+// Like S3, but with the given credentials and region
+func S3With(auth aws.Auth, region aws.Region) *s3.S3 {
+	myS3 := s3.New(auth, region)
+	switch *S3_SIGNATURE {
+	case "v2":
+		myS3.Signature = aws.V2Signature
+	case "v4":
+		myS3.Signature = aws.V4Signature
+	default:
+		log.Fatalf("Unsupported s3_signature: %s", *S3_SIGNATURE)
+	}
+	return myS3
 }
 
 func AWSAuth() (auth aws.Auth) {
@@ -18,7 +18,17 @@ var entryPoints = map[string]func([]string){
 	"cloudrun-status": commands.CloudRunStatusCommand,
 	"run":             commands.RunCommand,
 	"fileset-delete":  commands.FilesetDeleteCommand,
+	"fileset-diff":    commands.FilesetDiffCommand,
+	"fileset-show":    commands.FilesetShowCommand,
+	"gc":              commands.GCCommand,
+	"verify":          commands.VerifyCommand,
+	"bundle":          commands.BundleCommand,
+	"export":          commands.ExportCommand,
+	"serve":           commands.ServeCommand,
 	"filesets":        commands.FilesetsCommand,
+	"ref":             commands.RefCommand,
+	"log":             commands.LogCommand,
+	"key":             commands.KeyCommand,
 	"clone":           commands.CloneCommand,
 	"workspace":       commands.WorkspaceCommand,
 	"pool-create":     commands.PoolCreateCommand,
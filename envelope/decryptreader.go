@@ -0,0 +1,50 @@
+package envelope
+
+import (
+	"errors"
+	"io"
+)
+
+var errTruncated = errors.New("encrypted data is truncated")
+
+func (this *decryptReader) Read(p []byte) (n int, err error) {
+	for len(this.plain) == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		if err = this.open(); err != nil {
+			return
+		}
+	}
+	n = copy(p, this.plain)
+	this.plain = this.plain[n:]
+	return
+}
+
+// Reads and decrypts the next segment
+func (this *decryptReader) open() error {
+	if this.buf == nil {
+		this.buf = make([]byte, segmentSize+this.aead.Overhead())
+	}
+	n, err := io.ReadFull(this.reader, this.buf)
+	if err == io.EOF {
+		return errTruncated
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// The final segment is the one followed by nothing
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		if _, peekErr := this.reader.Peek(1); peekErr == io.EOF {
+			final = true
+		}
+	}
+	plain, err := this.aead.Open(this.buf[:0], segmentNonce(this.counter, final), this.buf[:n], nil)
+	if err != nil {
+		return err
+	}
+	this.counter++
+	this.plain = plain
+	this.done = final
+	return nil
+}
@@ -0,0 +1,33 @@
+package envelope
+
+func (this *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// Always hold back a full segment, since we don't know yet whether it
+		// is the final one
+		if len(this.buf) == segmentSize {
+			if err = this.seal(false); err != nil {
+				return
+			}
+		}
+		room := segmentSize - len(this.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		this.buf = append(this.buf, p[:room]...)
+		p = p[room:]
+		n += room
+	}
+	return
+}
+
+func (this *encryptWriter) Close() error {
+	return this.seal(true)
+}
+
+func (this *encryptWriter) seal(final bool) error {
+	sealed := this.aead.Seal(nil, segmentNonce(this.counter, final), this.buf, nil)
+	this.counter++
+	this.buf = this.buf[:0]
+	_, err := this.writer.Write(sealed)
+	return err
+}
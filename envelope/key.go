@@ -0,0 +1,37 @@
+package envelope
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// Encrypts a data key with this key, returning it base64 encoded
+func (this *Key) Wrap(dataKey []byte) (string, error) {
+	aead, err := newAEAD(this.secret)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := random(aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a data key wrapped with this key
+func (this *Key) Unwrap(wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(this.secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
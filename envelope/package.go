@@ -0,0 +1,143 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	KeySize = 32
+	// Size of the plaintext segments data is sealed in
+	segmentSize = 64 * 1024
+)
+
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("encryption keys must be %d bytes, got %d", KeySize, len(secret))
+	}
+	sum := sha256.Sum256(secret)
+	return &Key{secret, hex.EncodeToString(sum[:8])}, nil
+}
+
+// Loads a key file containing either the raw key or its hex encoding
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		data = decoded
+	}
+	return NewKey(data)
+}
+
+// Writes a new random key, hex encoded, to a file only the user can read
+func GenerateKeyFile(path string) (*Key, error) {
+	secret, err := random(KeySize)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(secret)
+}
+
+// Derives a key from a passphrase with scrypt
+func DeriveKey(passphrase string, salt []byte) (*Key, error) {
+	secret, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(secret)
+}
+
+func NewSalt() ([]byte, error) {
+	return random(16)
+}
+
+// Returns a fresh random data key for encrypting a single object
+func NewDataKey() ([]byte, error) {
+	return random(KeySize)
+}
+
+// Returns a writer that encrypts everything written to it with the data key
+// and writes the result to w.  Close must be called to write the final
+// segment; it does not close w.
+func NewWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{writer: w, aead: aead, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+// Returns a reader that decrypts data written by an encrypting writer.  Reads
+// fail if the data was tampered with or truncated.
+func NewReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{reader: bufio.NewReaderSize(r, segmentSize+aead.Overhead()), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Each data key encrypts a single object, so nonces only need to be unique
+// within it: a segment counter, plus a flag marking the final segment so that
+// truncation is detected.
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	for i := 0; i < 8; i++ {
+		nonce[i] = byte(counter >> uint(56-8*i))
+	}
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func random(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+// Convenience wrapper for encrypting small objects such as fileset manifests
+func Seal(data []byte, dataKey []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func Open(data []byte, dataKey []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,67 @@
+package envelope
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func roundTrip(t *testing.T, size int) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	dataKey, _ := NewDataKey()
+
+	sealed, err := Seal(data, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(sealed, dataKey)
+	if err != nil {
+		t.Fatalf("size %d: %s", size, err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Fatalf("size %d: decrypted data differs", size)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 17} {
+		roundTrip(t, size)
+	}
+}
+
+func TestTruncationDetected(t *testing.T) {
+	data := make([]byte, 3*segmentSize)
+	dataKey, _ := NewDataKey()
+	sealed, _ := Seal(data, dataKey)
+
+	// Dropping the final segment leaves a stream of valid, non-final segments
+	truncated := sealed[:2*(segmentSize+16)]
+	r, _ := NewReader(bytes.NewReader(truncated), dataKey)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("truncated data decrypted without error")
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	salt, _ := NewSalt()
+	key, err := DeriveKey("correct horse", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := DeriveKey("battery staple", salt)
+	dataKey, _ := NewDataKey()
+
+	wrapped, err := key.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := key.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatal("unwrapped data key differs")
+	}
+	if _, err = other.Unwrap(wrapped); err == nil {
+		t.Fatal("unwrapped with the wrong key")
+	}
+}
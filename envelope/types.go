@@ -0,0 +1,33 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"io"
+)
+
+// A key encryption key.  Data is never encrypted with it directly; it only
+// wraps the random data keys that each object is encrypted with, so changing
+// it only requires re-wrapping those data keys.
+type Key struct {
+	secret []byte
+	// Short fingerprint of the key, safe to store alongside the data
+	ID string
+}
+
+// Encrypts everything written to it as a sequence of AES-GCM sealed segments
+type encryptWriter struct {
+	writer  io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+type decryptReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
@@ -41,8 +41,7 @@ func (bldr *builder) visitFile(path string, info os.FileInfo) (entry *Entry) {
 }
 
 func (bldr *builder) visitDirectory(path string, info os.FileInfo) (entry *Entry) {
-	if bldr.shouldIgnore(info.Name()) {
-		log.Println("Ignoring", info.Name())
+	if bldr.shouldIgnore(path, true) {
 		return
 	}
 	dir, err := os.Open(path)
@@ -67,18 +66,19 @@ func (bldr *builder) visitDirectory(path string, info os.FileInfo) (entry *Entry
 func (bldr *builder) visitRegularFile(path string, info os.FileInfo) (entry *Entry) {
 	relPath, _ := filepath.Rel(bldr.cfg.RootPath, path)
 
-	if bldr.shouldIgnore(info.Name()) {
-		log.Println("Ignoring", info.Name())
+	if bldr.shouldIgnore(path, false) {
 		return
 	}
 	var (
 		digest string
+		chunks []Chunk
 		err    error
 	)
 	if info.Size() > 0 && bldr.cfg.GenDigest == true {
 		cachedEntry := bldr.CachedEntryMap[relPath]
 		if cachedEntry != nil && cachedEntry.ModTime == info.ModTime() {
 			digest = bldr.CachedEntryMap[relPath].Digest
+			chunks = bldr.CachedEntryMap[relPath].Chunks
 		} else {
 			var fp *os.File
 			fp, err = os.Open(path)
@@ -95,13 +95,13 @@ func (bldr *builder) visitRegularFile(path string, info os.FileInfo) (entry *Ent
 	entry = new(Entry)
 	entry.Size = info.Size()
 	entry.Digest = digest
+	entry.Chunks = chunks
 	bldr.fileSet.Size += entry.Size
 	return
 }
 
 func (bldr *builder) visitLink(path string, info os.FileInfo) (entry *Entry) {
-	if bldr.shouldIgnore(info.Name()) {
-		log.Println("Ignoring", info.Name())
+	if bldr.shouldIgnore(path, false) {
 		return
 	}
 	target, err := os.Readlink(path)
@@ -121,11 +121,11 @@ func (bldr *builder) visitLink(path string, info os.FileInfo) (entry *Entry) {
 	return
 }
 
-func (bldr *builder) shouldIgnore(name string) bool {
-	for _, key := range bldr.cfg.IgnoreList {
-		if key == name {
-			return true
-		}
+func (bldr *builder) shouldIgnore(path string, isDir bool) bool {
+	relPath, err := filepath.Rel(bldr.cfg.RootPath, path)
+	if err != nil || !bldr.ignoreRules.Ignored(relPath, isDir) {
+		return false
 	}
-	return false
+	log.Println("Ignoring", relPath)
+	return true
 }
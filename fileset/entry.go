@@ -12,6 +12,7 @@ func (this Entry) Equal(other *Entry) bool {
 	equal = equal && (this.Size == other.Size)
 	equal = equal && (this.Digest == other.Digest)
 	equal = equal && (this.Target == other.Target)
+	equal = equal && equalChunks(this.Chunks, other.Chunks)
 	equal = equal && (len(this.Tree) == len(other.Tree))
 	if equal {
 		for name, thisEntry := range this.Tree {
@@ -118,6 +119,7 @@ func (entry *Entry) DuplicateMetadata() (newEntry *Entry) {
 	newEntry.Size = entry.Size
 	newEntry.Digest = entry.Digest
 	newEntry.Target = entry.Target
+	newEntry.Chunks = entry.Chunks
 	if entry.Mode.IsDir() {
 		newEntry.Tree = make(EntryMap)
 	}
@@ -131,9 +133,41 @@ func (entry *Entry) EqualMetadata(entryTwo *Entry) bool {
 	equal = equal && (entry.Size == entryTwo.Size)
 	equal = equal && (entry.Digest == entryTwo.Digest)
 	equal = equal && (entry.Target == entryTwo.Target)
+	equal = equal && equalChunks(entry.Chunks, entryTwo.Chunks)
 	return equal
 }
 
+func equalChunks(chunks []Chunk, other []Chunk) bool {
+	if len(chunks) != len(other) {
+		return false
+	}
+	for i, chunk := range chunks {
+		if chunk != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the digests (mapped to their sizes) of every blob that must exist in
+// remote storage for this entry tree: the chunks of chunked files and the
+// whole contents of all other non-empty files.
+func (entry *Entry) BlobDigests() map[string]int64 {
+	blobs := make(map[string]int64)
+	walkFn := func(fullPath string, entry *Entry) error {
+		if len(entry.Chunks) > 0 {
+			for _, chunk := range entry.Chunks {
+				blobs[chunk.Digest] = chunk.Size
+			}
+		} else if len(entry.Digest) > 0 {
+			blobs[entry.Digest] = entry.Size
+		}
+		return nil
+	}
+	entry.Walk(walkFn)
+	return blobs
+}
+
 func walk(fullPath string, entry *Entry, walkFn WalkFunc) {
 	walkFn(fullPath, entry)
 	for name, child := range entry.Tree {
@@ -32,8 +32,9 @@ func (filter FileSetFilter) ApplyToFileSet(fullRoot *Entry, changesRoot *Entry)
 
 func getMatchingFiles(filter FileSetFilter, root *Entry) (matchPaths []string) {
 	matchPaths = make([]string, 0)
+	pathFilter := NewPathFilter(filter)
 	walkFn := func(fullPath string, entry *Entry) error {
-		if(isMatch(fullPath, filter)) {
+		if(pathFilter.Match(fullPath, entry.Mode.IsDir())) {
 			matchPaths = append(matchPaths, fullPath)
 		}
 		return nil
@@ -44,10 +45,11 @@ func getMatchingFiles(filter FileSetFilter, root *Entry) (matchPaths []string) {
 
 func getStaticFiles(filter FileSetFilter, root *Entry) (staticPaths []string) {
 	staticPaths = make([]string, 0)
+	pathFilter := NewPathFilter(filter)
 	walkFn := func(fullPath string, entry *Entry) error {
 		if(!entry.Mode.IsDir() || entry.Tree == nil || len(entry.Tree) == 0) {
 			// files or leaf dirs, need to do a pattern test
-			if(!isMatch(fullPath, filter)) {
+			if(!pathFilter.Match(fullPath, entry.Mode.IsDir())) {
 				staticPaths = append(staticPaths, fullPath)
 			}
 		}
@@ -119,6 +121,7 @@ func entryTreeDeepInsert(root *Entry, srcEntries EntryMap, path []string) error
 			currEntry.Size = srcEntries[subPathStr].Size
 			currEntry.Digest = srcEntries[subPathStr].Digest
 			currEntry.Target = srcEntries[subPathStr].Target
+			currEntry.Chunks = srcEntries[subPathStr].Chunks
 			currEntry = currEntry.Tree[name]
 		} else {
 			// this node is fine
@@ -153,14 +156,3 @@ func debugTree(root *Entry) {
 		fmt.Println(path)
 	}
 }
-
-func isMatch(s string, patterns []string) (match bool) {
-	match = false
-	for _, pattern := range patterns {
-		this_match, _ := filepath.Match(pattern, s)
-		if this_match {
-			match = true
-		}
-	}
-	return
-}
\ No newline at end of file
@@ -27,6 +27,7 @@ func GetDirectoryRootEntry(path string) *Entry {
 		make([]string, 16, 16),
 		builderCfg,
 		nil,
+		nil,
 	}
 	rootEntry := builder.visitFile(path, rootInfo)
 	return rootEntry
@@ -0,0 +1,32 @@
+package fileset
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Whether the path, relative to the root the rules apply to, is ignored,
+// either by a rule matching it or because one of its parent directories is
+func (rules IgnoreRules) Ignored(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if len(rules) == 0 || relPath == "." {
+		return false
+	}
+	components := strings.Split(relPath, "/")
+	for i := 1; i < len(components); i++ {
+		if rules.decide(components[:i], true) {
+			return true
+		}
+	}
+	return rules.decide(components, isDir)
+}
+
+// Applies the rules to the path itself, ignoring its parents
+func (rules IgnoreRules) decide(components []string, isDir bool) (ignored bool) {
+	for _, rule := range rules {
+		if rule.matches(components, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return
+}
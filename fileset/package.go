@@ -1,6 +1,7 @@
 package fileset
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
@@ -8,16 +9,44 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
 
 var SkipEntry = errors.New("skip this entry")
 
+// Content-defined chunking parameters.  Chunk boundaries fall where the gear
+// hash of the preceding bytes has its top bits clear, giving chunks of about
+// 2 MiB on average.  Changing any of these changes every chunk boundary.
+const (
+	MinChunkSize = 512 * 1024
+	MaxChunkSize = 8 * 1024 * 1024
+	chunkMask    = uint64(1<<21-1) << (64 - 21)
+)
+
+// Files smaller than this are always stored whole
+const ChunkedFileSize = MaxChunkSize
+
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64 seeded with "earthkit", so the table is identical everywhere
+	seed := uint64(0x65617274686b6974)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
 //func Build(rootPath string, allowExtLinks bool, genDigest bool) BuildResult {
 func Build(builderCfg BuilderCfg, cachedFileSet *FileSet, patterns FileSetFilter) BuildResult {
 	// Make the root path absolute if it isn't already
@@ -47,6 +76,7 @@ func Build(builderCfg BuilderCfg, cachedFileSet *FileSet, patterns FileSetFilter
 		make([]string, 16, 16),
 		builderCfg,
 		cachedEntryMap,
+		ParseIgnoreRules(builderCfg.IgnoreList),
 	}
 	rootEntry := builder.visitFile(rootPath, rootInfo)
 
@@ -89,10 +119,374 @@ func Hexdigest(reader io.Reader) (digest string, err error) {
 	return
 }
 
+// Splits everything read from reader into content-defined chunks, calling fn
+// with each chunk in order.  The slice passed to fn is reused afterwards.
+func SplitChunks(reader io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, 0, MaxChunkSize)
+	br := bufio.NewReaderSize(reader, 64*1024)
+	var hash uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		hash = (hash << 1) + gearTable[b]
+		if (len(buf) >= MinChunkSize && hash&chunkMask == 0) || len(buf) == MaxChunkSize {
+			if err = fn(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			hash = 0
+		}
+	}
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+	return nil
+}
+
+// Splits the file at the given path into content-defined chunks
+func ChunkFile(path string) (chunks []Chunk, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	err = SplitChunks(fp, func(chunk []byte) error {
+		digest, err := Hexdigest(bytes.NewReader(chunk))
+		if err == nil {
+			chunks = append(chunks, Chunk{digest, int64(len(chunk))})
+		}
+		return err
+	})
+	return
+}
+
+// Three-way merges two filesets derived from a common base, replaying the
+// changes made in ours on top of theirs.  Entries are compared by content, so
+// a file that was only touched doesn't count as changed.  Paths changed
+// differently on both sides are returned as conflicts, and merged is nil.
+// The merged fileset takes the rest of its metadata from ours.
+func Merge(base, ours, theirs *FileSet) (merged *FileSet, conflicts []string) {
+	baseMap := base.Root.Flatten()
+	ourMap := ours.Root.Flatten()
+	theirMap := theirs.Root.Flatten()
+
+	paths := make([]string, 0, len(ourMap))
+	seen := make(map[string]bool)
+	for _, entryMap := range []EntryMap{baseMap, ourMap, theirMap} {
+		for path, _ := range entryMap {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	// A directory sorts before everything inside it
+	sort.Strings(paths)
+
+	merged = &FileSet{CrTime: ours.CrTime, Comment: ours.Comment, Author: ours.Author, Host: ours.Host}
+	merged.Root = ours.Root.DuplicateMetadata()
+	merged.Count = 1
+	mergedMap := EntryMap{".": merged.Root}
+	for _, path := range paths {
+		b, o, t := baseMap[path], ourMap[path], theirMap[path]
+		var entry *Entry
+		switch {
+		case sameContent(o, t):
+			entry = o
+		case sameContent(b, o):
+			entry = t
+		case sameContent(b, t):
+			entry = o
+		case o != nil && t != nil && o.Mode.IsDir() && t.Mode.IsDir():
+			// Only the directory's mode differs; its contents merge separately
+			entry = o
+		default:
+			conflicts = append(conflicts, path)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		// The parent may have been removed, or replaced by a file, on the
+		// other side
+		parent := mergedMap[filepath.Dir(path)]
+		if parent == nil || parent.Tree == nil {
+			conflicts = append(conflicts, path)
+			continue
+		}
+		newEntry := entry.DuplicateMetadata()
+		parent.Tree[filepath.Base(path)] = newEntry
+		mergedMap[path] = newEntry
+		merged.Count++
+		if newEntry.Mode.IsRegular() {
+			merged.Size += newEntry.Size
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, conflicts
+	}
+	return
+}
+
+// Compares two entry maps (as returned by Entry.Flatten) by content.  Each
+// added file is matched against the removed files with the same digest to
+// detect renames, and failing that against the files in oldMap to detect
+// copies.  Empty files are never matched, since they all share a digest.
+func DiffFileSets(oldMap, newMap EntryMap) *FileSetDiff {
+	diff := new(FileSetDiff)
+	dirs := make(map[string]*DirDelta)
+	account := func(path string, size int64) {
+		for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+			delta := dirs[dir]
+			if delta == nil {
+				delta = &DirDelta{Path: dir}
+				dirs[dir] = delta
+			}
+			if size > 0 {
+				delta.Added += size
+			} else {
+				delta.Removed -= size
+			}
+			delta.Delta += size
+			if dir == "." {
+				break
+			}
+		}
+		diff.SizeDelta += size
+	}
+	fileSize := func(entry *Entry) int64 {
+		if entry.Mode.IsRegular() {
+			return entry.Size
+		}
+		return 0
+	}
+
+	paths := make([]string, 0, len(newMap))
+	for path, _ := range newMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var added, removed []string
+	for _, path := range paths {
+		newEntry, oldEntry := newMap[path], oldMap[path]
+		if oldEntry == nil {
+			added = append(added, path)
+			continue
+		}
+		var changes []string
+		if oldEntry.Mode&os.ModeType != newEntry.Mode&os.ModeType {
+			changes = append(changes, "type")
+		} else if oldEntry.Mode != newEntry.Mode {
+			changes = append(changes, "mode")
+		}
+		if !newEntry.Mode.IsDir() && (oldEntry.Size != newEntry.Size || oldEntry.Digest != newEntry.Digest) {
+			changes = append(changes, "content")
+		}
+		if oldEntry.Target != newEntry.Target {
+			changes = append(changes, "target")
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		diff.Modified = append(diff.Modified, DiffEntry{Path: path, IsDir: newEntry.Mode.IsDir(),
+			OldSize: fileSize(oldEntry), NewSize: fileSize(newEntry), Changes: changes})
+		account(path, -fileSize(oldEntry))
+		account(path, fileSize(newEntry))
+	}
+	for path, _ := range oldMap {
+		if newMap[path] == nil {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+
+	// Where each digest can be found in oldMap, removed files first
+	removedByDigest := make(map[string][]string)
+	for _, path := range removed {
+		if entry := oldMap[path]; entry.Mode.IsRegular() && entry.Size > 0 {
+			removedByDigest[entry.Digest] = append(removedByDigest[entry.Digest], path)
+		}
+	}
+	existingByDigest := make(map[string]string)
+	for path, entry := range oldMap {
+		if entry.Mode.IsRegular() && entry.Size > 0 && newMap[path] != nil {
+			if other, ok := existingByDigest[entry.Digest]; !ok || path < other {
+				existingByDigest[entry.Digest] = path
+			}
+		}
+	}
+
+	renamedFrom := make(map[string]bool)
+	for _, path := range added {
+		entry := newMap[path]
+		size := fileSize(entry)
+		if entry.Mode.IsRegular() && entry.Size > 0 {
+			if candidates := removedByDigest[entry.Digest]; len(candidates) > 0 {
+				from := candidates[0]
+				removedByDigest[entry.Digest] = candidates[1:]
+				renamedFrom[from] = true
+				diff.Renamed = append(diff.Renamed, DiffEntry{Path: path, From: from, OldSize: size, NewSize: size})
+				account(from, -size)
+				account(path, size)
+				continue
+			}
+			if from, ok := existingByDigest[entry.Digest]; ok {
+				diff.Copied = append(diff.Copied, DiffEntry{Path: path, From: from, NewSize: size})
+				account(path, size)
+				continue
+			}
+		}
+		diff.Added = append(diff.Added, DiffEntry{Path: path, IsDir: entry.Mode.IsDir(), NewSize: size})
+		account(path, size)
+	}
+	for _, path := range removed {
+		if renamedFrom[path] {
+			continue
+		}
+		entry := oldMap[path]
+		diff.Removed = append(diff.Removed, DiffEntry{Path: path, IsDir: entry.Mode.IsDir(), OldSize: fileSize(entry)})
+		account(path, -fileSize(entry))
+	}
+
+	dirPaths := make([]string, 0, len(dirs))
+	for dir, delta := range dirs {
+		if delta.Added != 0 || delta.Removed != 0 {
+			dirPaths = append(dirPaths, dir)
+		}
+	}
+	sort.Strings(dirPaths)
+	for _, dir := range dirPaths {
+		diff.Dirs = append(diff.Dirs, *dirs[dir])
+	}
+	return diff
+}
+
+// Reports whether two entries (either of which may be nil) have the same type
+// and content, ignoring modification times.
+func sameContent(entry, other *Entry) bool {
+	if entry == nil || other == nil {
+		return entry == other
+	}
+	if entry.Mode != other.Mode {
+		return false
+	}
+	if entry.Mode.IsDir() {
+		return true
+	}
+	return entry.Size == other.Size && entry.Digest == other.Digest && entry.Target == other.Target
+}
+
 func FileSetNameFromFile(filepath string) string {
 	return strings.Replace(path.Base(filepath), ".json.gz", "", 1)
 }
 
+// Parses the lines of a .earthkitignore file.  Blank lines and lines
+// starting with "#" are skipped, as are trailing spaces unless escaped; each
+// other line is a pattern as described for parsePattern.
+func ParseIgnoreRules(lines []string) IgnoreRules {
+	rules := make(IgnoreRules, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rule, ok := parsePattern(line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Compiles the patterns given to -filters, as described for parsePattern
+func NewPathFilter(patterns []string) *PathFilter {
+	filter := &PathFilter{selectUnmatched: true}
+	for _, line := range patterns {
+		if p, ok := parsePattern(line); ok {
+			filter.patterns = append(filter.patterns, p)
+			if !p.negate {
+				filter.selectUnmatched = false
+			}
+		}
+	}
+	return filter
+}
+
+// Parses a pattern in gitignore syntax: "!" negates it, a trailing "/" only
+// matches directories, and a pattern containing any other "/" is anchored to
+// the root rather than matching at any depth.  Components are matched with
+// path.Match, so "*", "?" and character classes never match a "/", while a
+// "**" component matches any number of directories.  A leading "\" escapes
+// a "!" or "#".  Returns false for an empty pattern.
+func parsePattern(line string) (p pattern, ok bool) {
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	anchored := strings.Contains(line, "/")
+	p.components = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	if !anchored {
+		p.components = append([]string{"**"}, p.components...)
+	}
+	return p, true
+}
+
+// Reads the lines of an ignore file, returning none if it doesn't exist
+func ReadIgnoreFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// Matches the components of a slash separated path against a pattern split
+// the same way.  Each component is matched with path.Match, except "**",
+// which matches any number of components (and, at the end of the pattern,
+// at least one).
+func matchComponents(pattern, components []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(components) > 0
+			}
+			for i := 0; i <= len(components); i++ {
+				if matchComponents(pattern[1:], components[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], components[0]); !ok {
+			return false
+		}
+		pattern, components = pattern[1:], components[1:]
+	}
+	return len(components) == 0
+}
+
 // Takes two paths and joins them if the second path is not an absolute path.
 // If the second path is an absolute path, it is returned.
 func joinIfNotAbs(basepath string, otherpath string) string {
@@ -0,0 +1,222 @@
+package fileset
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func splitAll(t *testing.T, data []byte) [][]byte {
+	chunks := make([][]byte, 0)
+	err := SplitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestSplitChunks_Reassembles(t *testing.T) {
+	data := make([]byte, 3*MaxChunkSize+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := splitAll(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not reassemble to the original data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > MaxChunkSize || (len(chunk) < MinChunkSize && i != len(chunks)-1) {
+			t.Fatalf("chunk %d has out of range size %d", i, len(chunk))
+		}
+	}
+}
+
+// Inserting a few bytes at the start of a file should only change the chunks
+// around the insertion, not every chunk after it.
+func TestSplitChunks_ShiftResistant(t *testing.T) {
+	data := make([]byte, 8*MaxChunkSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	shifted := append([]byte("inserted"), data...)
+
+	original := make(map[string]bool)
+	for _, chunk := range splitAll(t, data) {
+		original[string(chunk)] = true
+	}
+	chunks := splitAll(t, shifted)
+	shared := 0
+	for _, chunk := range chunks {
+		if original[string(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Fatalf("only %d of %d chunks survived a small insertion", shared, len(chunks))
+	}
+}
+
+func mergeFileSet(files map[string]string) *FileSet {
+	root := &Entry{Mode: os.ModeDir | 0755, Tree: make(EntryMap)}
+	for path, digest := range files {
+		dir, name := filepath.Split(path)
+		parent := root
+		if dir != "" {
+			dir = filepath.Clean(dir)
+			if parent.Tree[dir] == nil {
+				parent.Tree[dir] = &Entry{Mode: os.ModeDir | 0755, Tree: make(EntryMap)}
+			}
+			parent = parent.Tree[dir]
+		}
+		parent.Tree[name] = &Entry{Mode: 0644, Size: int64(len(digest)), Digest: digest}
+	}
+	return &FileSet{Root: root}
+}
+
+func TestMerge(t *testing.T) {
+	base := mergeFileSet(map[string]string{"a": "1", "b": "1", "d/c": "1"})
+	ours := mergeFileSet(map[string]string{"a": "2", "b": "1", "d/c": "1", "d/new": "1"})
+	theirs := mergeFileSet(map[string]string{"a": "1", "d/c": "3"})
+
+	merged, conflicts := Merge(base, ours, theirs)
+	if len(conflicts) > 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	entries := merged.Root.Flatten()
+	if entries["a"].Digest != "2" || entries["d/c"].Digest != "3" || entries["d/new"] == nil {
+		t.Fatal("changes from both sides were not merged")
+	}
+	if entries["b"] != nil {
+		t.Fatal("file removed by theirs was kept")
+	}
+	if merged.Count != 5 {
+		t.Fatalf("merged count is %d, want 5", merged.Count)
+	}
+
+	theirs = mergeFileSet(map[string]string{"a": "3", "b": "1", "d/c": "1"})
+	if _, conflicts = Merge(base, ours, theirs); len(conflicts) != 1 || conflicts[0] != "a" {
+		t.Fatalf("expected a conflict on a, got %v", conflicts)
+	}
+}
+
+func TestDiffFileSets(t *testing.T) {
+	old := mergeFileSet(map[string]string{"a": "111", "b": "22", "d/c": "3", "d/gone": "4444"})
+	new := mergeFileSet(map[string]string{"a": "111", "b": "222", "e/c": "3", "copy": "111"})
+
+	diff := DiffFileSets(old.Root.Flatten(), new.Root.Flatten())
+	if len(diff.Renamed) != 1 || diff.Renamed[0].From != "d/c" || diff.Renamed[0].Path != "e/c" {
+		t.Fatalf("renames: %+v", diff.Renamed)
+	}
+	if len(diff.Copied) != 1 || diff.Copied[0].From != "a" || diff.Copied[0].Path != "copy" {
+		t.Fatalf("copies: %+v", diff.Copied)
+	}
+	if len(diff.Modified) != 1 || diff.Modified[0].Path != "b" {
+		t.Fatalf("modifications: %+v", diff.Modified)
+	}
+	// d/c moved out of d and d/gone was removed with d
+	var removed []string
+	for _, entry := range diff.Removed {
+		removed = append(removed, entry.Path)
+	}
+	if strings.Join(removed, ",") != "d,d/gone" {
+		t.Fatalf("removals: %v", removed)
+	}
+	if diff.SizeDelta != 3+1-4 {
+		t.Fatalf("size delta is %d", diff.SizeDelta)
+	}
+	for _, dir := range diff.Dirs {
+		if dir.Path == "d" && (dir.Removed != 5 || dir.Delta != -5) {
+			t.Fatalf("delta of d: %+v", dir)
+		}
+	}
+}
+
+func TestParseIgnoreRules(t *testing.T) {
+	rules := ParseIgnoreRules(strings.Split(`# scratch space
+.earthkit
+*.log
+!keep.log
+scratch/
+/build
+docs/**/draft
+logs/**
+\#notes
+trailing   `, "\n"))
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{".earthkit", true, true},
+		{"run.log", false, true},
+		{"a/b/run.log", false, true},
+		{"a/keep.log", false, false},
+		{"scratch", true, true},
+		{"scratch", false, false},
+		{"a/scratch/x", false, true},
+		{"build", true, true},
+		{"a/build", true, false},
+		{"docs/draft", false, true},
+		{"docs/a/b/draft", false, true},
+		{"logs", true, false},
+		{"logs/a/b", false, true},
+		// Nothing can be re-included from an ignored directory
+		{"scratch/keep.log", false, true},
+		{"#notes", false, true},
+		{"trailing", false, true},
+		{"src/main.go", false, false},
+	}
+	for _, c := range cases {
+		if ignored := rules.Ignored(c.path, c.isDir); ignored != c.ignored {
+			t.Errorf("Ignored(%q, %v) = %v", c.path, c.isDir, ignored)
+		}
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		selected bool
+	}{
+		// Patterns without a slash match at any depth
+		{[]string{"*.h5"}, "a.h5", false, true},
+		{[]string{"*.h5"}, "data/2020/a.h5", false, true},
+		{[]string{"*.h5"}, "data/a.nc", false, false},
+		// Patterns with one are anchored, and * doesn't cross directories
+		{[]string{"data/*.h5"}, "data/a.h5", false, true},
+		{[]string{"data/*.h5"}, "data/2020/a.h5", false, false},
+		{[]string{"data/**/*.h5"}, "data/2020/01/a.h5", false, true},
+		{[]string{"data/**/*.h5"}, "data/a.h5", false, true},
+		{[]string{"/data/**"}, "data/a/b", false, true},
+		{[]string{"data/[0-9]*"}, "data/2020", true, true},
+		{[]string{"data/[0-9]*"}, "data/raw", true, false},
+		// Directories select everything inside them
+		{[]string{"data"}, "data/2020/a.h5", false, true},
+		{[]string{"data/"}, "data/a.h5", false, true},
+		{[]string{"data/"}, "data", false, false},
+		// Exclusions apply in order, and alone exclude from everything
+		{[]string{"data", "!data/tmp"}, "data/tmp/a", false, false},
+		{[]string{"data", "!data/tmp"}, "data/a", false, true},
+		{[]string{"data", "!*.log", "keep.log"}, "data/keep.log", false, true},
+		{[]string{"data", "!*.log", "keep.log"}, "data/other.log", false, false},
+		{[]string{"!*.log"}, "src/main.go", false, true},
+		{[]string{"!*.log"}, "src/main.log", false, false},
+		{[]string{"*"}, ".", true, false},
+	}
+	for _, c := range cases {
+		if selected := NewPathFilter(c.patterns).Match(c.path, c.isDir); selected != c.selected {
+			t.Errorf("%v: Match(%q, %v) = %v", c.patterns, c.path, c.isDir, selected)
+		}
+	}
+
+	diff := EntryMap{"a.h5": &Entry{}, "sub/b.h5": &Entry{}, "sub/c.nc": &Entry{}}.Diff(EntryMap{}).Filter([]string{"*.h5"})
+	if len(diff.Removed) != 2 || diff.Removed["sub/b.h5"] == nil {
+		t.Errorf("EntryMapDiff.Filter kept %v", diff.Removed)
+	}
+}
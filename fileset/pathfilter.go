@@ -0,0 +1,38 @@
+package fileset
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Whether the path, relative to the root of the fileset, is selected.  A
+// pattern matching a directory matches everything inside it, so that later
+// patterns can make exceptions within it.  The root itself is never selected.
+func (filter *PathFilter) Match(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if relPath == "." {
+		return false
+	}
+	components := strings.Split(relPath, "/")
+	selected := filter.selectUnmatched
+	for _, p := range filter.patterns {
+		for i := 1; i <= len(components); i++ {
+			if p.matches(components[:i], i < len(components) || isDir) {
+				selected = !p.negate
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Returns the entries of the map the filter selects
+func (filter *PathFilter) FilterEntryMap(entryMap EntryMap) EntryMap {
+	filtered := make(EntryMap)
+	for path, entry := range entryMap {
+		if filter.Match(path, entry != nil && entry.Mode.IsDir()) {
+			filtered[path] = entry
+		}
+	}
+	return filtered
+}
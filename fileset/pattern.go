@@ -0,0 +1,9 @@
+package fileset
+
+// Whether the pattern matches the path, split at slashes, itself
+func (p pattern) matches(components []string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchComponents(p.components, components)
+}
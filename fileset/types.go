@@ -13,6 +13,41 @@ type EntryMapDiff struct {
 	Updated EntryMap
 }
 
+// A comparison of two entry maps by content, in which a file that was moved
+// or copied is reported as such rather than as a removal and an addition.
+// Modification times are ignored.  Paths are sorted.
+type FileSetDiff struct {
+	Added    []DiffEntry `json:"added"`
+	Removed  []DiffEntry `json:"removed"`
+	Modified []DiffEntry `json:"modified"`
+	Renamed  []DiffEntry `json:"renamed"`
+	Copied   []DiffEntry `json:"copied"`
+	// Changes in the size of every directory with changes below it, the
+	// root being "."
+	Dirs      []DirDelta `json:"dirs"`
+	SizeDelta int64      `json:"size_delta"`
+}
+
+type DiffEntry struct {
+	Path string `json:"path"`
+	// For renames and copies, the path the content came from
+	From    string `json:"from,omitempty"`
+	IsDir   bool   `json:"is_dir,omitempty"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+	// What changed about a modified entry: type, mode, content or target
+	Changes []string `json:"changes,omitempty"`
+}
+
+type DirDelta struct {
+	Path string `json:"path"`
+	// Bytes of files added to and removed from the directory or anything
+	// below it, renames and modifications included
+	Added   int64 `json:"added"`
+	Removed int64 `json:"removed"`
+	Delta   int64 `json:"delta"`
+}
+
 // The Entry struct doesn't need a type field since the Mode field encodes
 // mode bits which indicate whether it is a link, dir, etc.
 type Entry struct {
@@ -26,23 +61,36 @@ type Entry struct {
 	// File attributes
 	Size   int64  `json:"size,omitempty"`
 	Digest string `json:"_digest,omitempty"`
+	// Content-defined chunks making up the file, in order.  Empty for files
+	// that are stored whole under their Digest.
+	Chunks []Chunk `json:"_chunks,omitempty"`
 	// Target attributes
 	Target string `json:"target,omitempty"`
 }
 
+type Chunk struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
 type FileSet struct {
 	Size    int64     `json:"size"`
 	Count   int64     `json:"count"`
 	Root    *Entry    `json:"root"`
 	CrTime  time.Time `json:"crtime"`
 	Comment string    `json:"comment,omitempty"`
+	// Lineage: the fileset this one was derived from, and who created it where
+	Parent string `json:"parent,omitempty"`
+	Author string `json:"author,omitempty"`
+	Host   string `json:"host,omitempty"`
 }
 
 type BuilderCfg struct {
 	RootPath      string
 	AllowExtLinks bool
 	GenDigest     bool
-	IgnoreList    []string
+	// Paths to leave out, as lines of a .earthkitignore file
+	IgnoreList []string
 }
 
 type builder struct {
@@ -51,6 +99,29 @@ type builder struct {
 	visited        []string
 	cfg            BuilderCfg
 	CachedEntryMap EntryMap
+	ignoreRules    IgnoreRules
+}
+
+// Patterns in gitignore syntax, relative to the root of a workspace.  The
+// last pattern matching a path decides whether it is ignored, and nothing
+// inside an ignored directory can be brought back.
+type IgnoreRules []pattern
+
+// Compiled -filters patterns.  A path is selected by the last pattern
+// matching it or one of its parent directories, or if no pattern matches,
+// only when every pattern is an exclusion.
+type PathFilter struct {
+	patterns []pattern
+	// Whether paths no pattern matches are selected
+	selectUnmatched bool
+}
+
+// A path pattern shared by .earthkitignore files and -filters
+type pattern struct {
+	// The pattern split at slashes; unanchored patterns start with "**"
+	components []string
+	negate     bool
+	dirOnly    bool
 }
 
 type BuildResult interface {
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"github.com/opslabjpl/earthkit-cli/config"
 	"github.com/opslabjpl/goamz/ec2"
-	"github.com/opslabjpl/goamz/s3"
 	"github.com/opslabjpl/goprovision"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -168,9 +168,7 @@ func filterTargetMachines(targets []string, instances []ec2.Instance) (instances
 func (pool *Pool) genUserData() (userData string) {
 	userData = UserData
 
-	auth := config.AWSAuth()
-	myS3 := s3.New(auth, config.Region)
-	bucket := myS3.Bucket(*config.S3_BUCKET)
+	bucket := config.S3().Bucket(*config.S3_BUCKET)
 
 	discoveryURL := string(pool.Workspace.Remote().GetDiscoveryURL())
 
@@ -191,7 +189,11 @@ func (pool *Pool) genUserData() (userData string) {
 	userData = strings.Replace(userData, "__AWS_ACCESS_KEY__", *config.AWS_ACCESS_KEY, -1)
 	userData = strings.Replace(userData, "__AWS_SECRET_KEY__", *config.AWS_SECRET_KEY, -1)
 	userData = strings.Replace(userData, "__S3_BUCKET__", *config.S3_BUCKET, -1)
+	userData = strings.Replace(userData, "__S3_KEY_PREFIX__", *config.S3_KEY_PREFIX, -1)
 	userData = strings.Replace(userData, "__AWS_REGION__", *config.AWS_REGION, -1)
+	userData = strings.Replace(userData, "__S3_ENDPOINT__", *config.S3_ENDPOINT, -1)
+	userData = strings.Replace(userData, "__S3_PATH_STYLE__", strconv.FormatBool(*config.S3_PATH_STYLE), -1)
+	userData = strings.Replace(userData, "__S3_SIGNATURE__", *config.S3_SIGNATURE, -1)
 
 	userData = strings.Replace(userData, "__WORK_SPACE__", workspaceName, -1)
 	userData = strings.Replace(userData, "__DATA_DIR__", *config.DATA_DIR, -1)
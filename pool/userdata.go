@@ -27,7 +27,10 @@ cat << EOF  > /etc/ekit/earthkitrc
 aws_access_key = __AWS_ACCESS_KEY__
 aws_secret_key = __AWS_SECRET_KEY__
 s3bucket = __S3_BUCKET__
-s3keyprefix = .earthkit
+s3_key_prefix = __S3_KEY_PREFIX__
+s3_endpoint = __S3_ENDPOINT__
+s3_path_style = __S3_PATH_STYLE__
+s3_signature = __S3_SIGNATURE__
 EOF
 
 # setup etcd conf
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix given to files that are still being written.  They are renamed into
+// place on Close, so readers on other machines never see partial objects.
+const partialSuffix = ".partial"
+
+// Suffix of the json files holding object metadata, stored next to the object
+const metaSuffix = ".ekmeta"
+
+func (this *LocalStorage) List(prefix string) ([]Object, error) {
+	objects := make([]Object, 0, 64)
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	walkFn := func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(info.Name(), partialSuffix) || strings.HasSuffix(info.Name(), metaSuffix) {
+			return nil
+		}
+		key := this.key(fullPath)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{key, info.Size(), info.ModTime(), nil})
+		}
+		return nil
+	}
+	err := filepath.Walk(this.path(dir), walkFn)
+	return objects, err
+}
+
+func (this *LocalStorage) ListChildren(prefix string) ([]string, error) {
+	children := make([]string, 0, 64)
+	infos, err := ioutil.ReadDir(this.path(prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return children, err
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			children = append(children, path.Join(prefix, info.Name())+"/")
+		}
+	}
+	return children, nil
+}
+
+func (this *LocalStorage) Stat(key string) (object Object, err error) {
+	info, err := os.Stat(this.path(key))
+	if err != nil {
+		return
+	}
+	meta, err := readMeta(this.path(key))
+	object = Object{key, info.Size(), info.ModTime(), meta}
+	return
+}
+
+func (this *LocalStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(this.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (this *LocalStorage) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(this.path(key))
+}
+
+func (this *LocalStorage) Put(key string, data []byte) error {
+	w, err := this.NewWriter(key, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Directories left empty are removed too, so that like S3 prefixes they only
+// exist while they hold objects.
+func (this *LocalStorage) Delete(key string) error {
+	os.Remove(this.path(key) + metaSuffix)
+	err := os.Remove(this.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	root := filepath.Clean(this.root)
+	for dir := filepath.Dir(this.path(key)); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (this *LocalStorage) NewReader(key string) (io.ReadCloser, Metadata, error) {
+	f, err := os.Open(this.path(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := readMeta(this.path(key))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, meta, nil
+}
+
+func (this *LocalStorage) NewWriter(key string, meta Metadata) (Writer, error) {
+	fullPath := this.path(key)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fullPath), filepath.Base(fullPath)+".*"+partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{f, fullPath, meta}, nil
+}
+
+func (this *LocalStorage) NewRangeReader(key string, offset int64) (io.ReadCloser, Metadata, error) {
+	r, meta, err := this.NewReader(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = r.(*os.File).Seek(offset, os.SEEK_SET); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, meta, nil
+}
+
+// The partial file of a resumable upload has a fixed name, recorded as the
+// upload id, and the upload resumes from however much of it was written.
+func (this *LocalStorage) NewResumableWriter(key string, meta Metadata, state UploadState, checkpoint func(UploadState)) (Writer, int64, error) {
+	fullPath := this.path(key)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, 0, err
+	}
+	partial := fullPath + ".resumable" + partialSuffix
+	flags := os.O_CREATE | os.O_WRONLY
+	if state.UploadID != filepath.Base(partial) {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flags, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	resumeAt, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	checkpoint(UploadState{UploadID: filepath.Base(partial)})
+	return &localWriter{f, fullPath, meta}, resumeAt, nil
+}
+
+func (this *LocalStorage) AbortUpload(key string, state UploadState) error {
+	partial := this.path(key) + ".resumable" + partialSuffix
+	if state.UploadID != filepath.Base(partial) {
+		return nil
+	}
+	if err := os.Remove(partial); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (this *LocalStorage) Location() string {
+	if root, err := filepath.Abs(this.root); err == nil {
+		return root
+	}
+	return this.root
+}
+
+func (this *LocalStorage) SetMeta(key string, meta Metadata) error {
+	if _, err := os.Stat(this.path(key)); err != nil {
+		return err
+	}
+	return writeMeta(this.path(key), meta)
+}
+
+func (this *LocalStorage) path(key string) string {
+	return filepath.Join(this.root, filepath.FromSlash(key))
+}
+
+func (this *LocalStorage) key(fullPath string) string {
+	rel, _ := filepath.Rel(this.root, fullPath)
+	return filepath.ToSlash(rel)
+}
+
+func (this *localWriter) Write(p []byte) (int, error) {
+	return this.file.Write(p)
+}
+
+func (this *localWriter) Close() error {
+	// TempFile creates files readable only by us, but the directory may be shared
+	err := this.file.Chmod(0644)
+	if err == nil {
+		err = this.file.Close()
+	} else {
+		this.file.Close()
+	}
+	if err == nil {
+		err = writeMeta(this.path, this.meta)
+	}
+	if err != nil {
+		os.Remove(this.file.Name())
+		return err
+	}
+	return os.Rename(this.file.Name(), this.path)
+}
+
+func (this *localWriter) Abort() error {
+	this.file.Close()
+	return os.Remove(this.file.Name())
+}
+
+// Reads the metadata stored next to the file at fullPath, if there is any
+func readMeta(fullPath string) (Metadata, error) {
+	meta := make(Metadata)
+	data, err := ioutil.ReadFile(fullPath + metaSuffix)
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// Replaces the metadata stored next to the file at fullPath
+func writeMeta(fullPath string, meta Metadata) error {
+	if len(meta) == 0 {
+		err := os.Remove(fullPath + metaSuffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath+metaSuffix, data, 0644)
+}
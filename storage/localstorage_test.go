@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempStorage(t *testing.T) (*LocalStorage, func()) {
+	dir, err := ioutil.TempDir("", "earthkit-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocal(dir), func() { os.RemoveAll(dir) }
+}
+
+func TestLocalStorage_PutGetDelete(t *testing.T) {
+	store, cleanup := tempStorage(t)
+	defer cleanup()
+
+	key := ".earthkit/ws/files/abc"
+	if err := store.Put(key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(key)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Get returned %q, %v", data, err)
+	}
+	if exists, _ := store.Exists(key); !exists {
+		t.Fatal("object should exist after Put")
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := store.Exists(key); exists {
+		t.Fatal("object should not exist after Delete")
+	}
+	// Deleting a missing object is not an error, just like S3
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalStorage_ListAndChildren(t *testing.T) {
+	store, cleanup := tempStorage(t)
+	defer cleanup()
+
+	store.Put(".earthkit/ws1/filesets/a.json.gz", []byte("a"))
+	store.Put(".earthkit/ws1/filesets/b.json.gz", []byte("bb"))
+	store.Put(".earthkit/ws2/discovery_url", []byte("url"))
+
+	objects, err := store.List(".earthkit/ws1/filesets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %v", objects)
+	}
+	children, err := store.ListChildren(".earthkit/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children[0] != ".earthkit/ws1/" || children[1] != ".earthkit/ws2/" {
+		t.Fatalf("unexpected children %v", children)
+	}
+	// Listing a prefix that does not exist yet is not an error
+	objects, err = store.List(".earthkit/ws3/")
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("expected no objects, got %v, %v", objects, err)
+	}
+}
+
+func TestLocalStorage_AbortedWriteIsInvisible(t *testing.T) {
+	store, cleanup := tempStorage(t)
+	defer cleanup()
+
+	w, err := store.NewWriter("blob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	if objects, _ := store.List(""); len(objects) != 0 {
+		t.Fatalf("partial object should not be listed: %v", objects)
+	}
+	w.Abort()
+	if exists, _ := store.Exists("blob"); exists {
+		t.Fatal("aborted object should not exist")
+	}
+}
+
+func TestLocalStorage_Metadata(t *testing.T) {
+	store, cleanup := tempStorage(t)
+	defer cleanup()
+
+	w, err := store.NewWriter("blob", Metadata{"compression": "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, meta, err := store.NewReader("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if meta["compression"] != "gzip" {
+		t.Fatalf("unexpected metadata %v", meta)
+	}
+	// Metadata files are not objects
+	if objects, _ := store.List(""); len(objects) != 1 {
+		t.Fatalf("expected only the object to be listed, got %v", objects)
+	}
+	// Overwriting without metadata drops the old metadata
+	store.Put("blob", []byte("data"))
+	if object, _ := store.Stat("blob"); len(object.Meta) != 0 {
+		t.Fatalf("stale metadata %v", object.Meta)
+	}
+}
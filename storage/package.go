@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"github.com/opslabjpl/earthkit-cli/config"
+	"github.com/opslabjpl/goamz/aws"
+	"github.com/opslabjpl/goamz/s3"
+	"io"
+	"log"
+)
+
+// Default size of the parts large objects are uploaded to S3 in, which is
+// also the smallest S3 accepts
+const PartSize = 5 * 1024 * 1024
+
+// Largest object S3 will copy in a single request
+const maxServerSideCopy = 5 * 1024 * 1024 * 1024
+
+// Returns the Storage selected by the "storage" option in .earthkitrc
+func New() Storage {
+	switch *config.STORAGE {
+	case "s3":
+		return NewS3Bucket(*config.S3_BUCKET, *config.AWS_REGION, config.AWSAuth())
+	case "local":
+		if *config.STORAGE_DIR == "" {
+			log.Fatal("storage_dir must be set when using local storage")
+		}
+		return NewLocal(*config.STORAGE_DIR)
+	}
+	log.Fatalf("Unsupported storage backend: %s", *config.STORAGE)
+	return nil
+}
+
+func NewS3(bucket *s3.Bucket) *S3Storage {
+	return &S3Storage{bucket, PartSize}
+}
+
+// Returns storage for any S3 bucket, possibly in another region or account
+// than the configured one.  Large objects are uploaded in part_size parts.
+func NewS3Bucket(bucket, region string, auth aws.Auth) *S3Storage {
+	if *config.PART_SIZE < PartSize {
+		log.Fatalf("part_size must be at least %d bytes", PartSize)
+	}
+	var s3Region aws.Region
+	if region == *config.AWS_REGION {
+		s3Region = config.S3Region()
+	} else {
+		s3Region = config.S3RegionNamed(region)
+	}
+	s3Storage := NewS3(config.S3With(auth, s3Region).Bucket(bucket))
+	s3Storage.partSize = *config.PART_SIZE
+	return s3Storage
+}
+
+func NewLocal(root string) *LocalStorage {
+	return &LocalStorage{root}
+}
+
+// Copies an object and its metadata, possibly between storages.  Objects are
+// copied server side when S3 can do so; everything else is streamed through
+// this machine.
+func Copy(src Storage, srcKey string, dst Storage, dstKey string) error {
+	if s3Src, ok := src.(*S3Storage); ok {
+		if s3Dst, ok := dst.(*S3Storage); ok && s3Dst.canCopyFrom(s3Src) {
+			object, err := src.Stat(srcKey)
+			if err != nil {
+				return err
+			}
+			if object.Size <= maxServerSideCopy {
+				return s3Dst.copyFrom(s3Src, srcKey, dstKey)
+			}
+		}
+	}
+	r, meta, err := src.NewReader(srcKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.NewWriter(dstKey, meta)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/opslabjpl/goamz/s3"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const metaHeaderPrefix = "x-amz-meta-"
+
+func (this *S3Storage) List(prefix string) ([]Object, error) {
+	objects := make([]Object, 0, 64)
+	results, errs := this.bucket.ListAllAsync(prefix)
+	for key := range results {
+		lastModified, _ := time.Parse(time.RFC3339, key.LastModified)
+		objects = append(objects, Object{key.Key, key.Size, lastModified, nil})
+	}
+	err := <-errs
+	return objects, err
+}
+
+func (this *S3Storage) ListChildren(prefix string) ([]string, error) {
+	children := make([]string, 0, 64)
+	prefixes, errs := this.bucket.ListAllChildrenAsync(prefix, "/")
+	for child := range prefixes {
+		children = append(children, child)
+	}
+	err := <-errs
+	return children, err
+}
+
+func (this *S3Storage) Stat(key string) (object Object, err error) {
+	resp, err := this.bucket.Head(key, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", key, resp.Status)
+		return
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	object = Object{key, resp.ContentLength, lastModified, metaFromHeader(resp.Header)}
+	return
+}
+
+func (this *S3Storage) Exists(key string) (bool, error) {
+	return this.bucket.Exists(key)
+}
+
+func (this *S3Storage) Get(key string) ([]byte, error) {
+	return this.bucket.Get(key)
+}
+
+func (this *S3Storage) Put(key string, data []byte) error {
+	return this.bucket.Put(key, data, "application/octet-stream", s3.Private, s3.Options{})
+}
+
+func (this *S3Storage) Delete(key string) error {
+	return this.bucket.Del(key)
+}
+
+func (this *S3Storage) NewReader(key string) (io.ReadCloser, Metadata, error) {
+	resp, err := this.bucket.GetResponse(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, metaFromHeader(resp.Header), nil
+}
+
+func (this *S3Storage) NewRangeReader(key string, offset int64) (io.ReadCloser, Metadata, error) {
+	if offset == 0 {
+		return this.NewReader(key)
+	}
+	headers := map[string][]string{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	resp, err := this.bucket.GetResponseWithHeaders(key, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: range request returned %s", key, resp.Status)
+	}
+	return resp.Body, metaFromHeader(resp.Header), nil
+}
+
+func (this *S3Storage) Location() string {
+	return this.bucket.Region.S3Endpoint + "/" + this.bucket.Name
+}
+
+// S3 can't modify metadata in place, so the object is copied onto itself.
+// S3 only copies objects of up to 5 GB in one request, so larger ones are
+// streamed through this machine into a new upload instead, which replaces
+// the object once it completes.
+func (this *S3Storage) SetMeta(key string, meta Metadata) error {
+	object, err := this.Stat(key)
+	if err != nil {
+		return err
+	}
+	if object.Size > maxServerSideCopy {
+		r, _, err := this.NewReader(key)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := this.NewWriter(key, meta)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, r); err != nil {
+			w.Abort()
+			return err
+		}
+		return w.Close()
+	}
+	writer := s3Writer{meta: meta}
+	options := s3.CopyOptions{Options: writer.options(), MetadataDirective: "REPLACE"}
+	_, err = this.bucket.PutCopy(key, s3.Private, options, this.bucket.Name+"/"+key)
+	return err
+}
+
+// S3 only copies objects server side within a region, and the credentials
+// used must be able to read the source, which we only know for certain when
+// they are the same.
+func (this *S3Storage) canCopyFrom(src *S3Storage) bool {
+	return this.bucket.Region.S3Endpoint == src.bucket.Region.S3Endpoint &&
+		this.bucket.Auth.AccessKey == src.bucket.Auth.AccessKey
+}
+
+// Copies an object from src, which canCopyFrom must allow, metadata and all
+func (this *S3Storage) copyFrom(src *S3Storage, srcKey, dstKey string) error {
+	options := s3.CopyOptions{MetadataDirective: "COPY"}
+	_, err := this.bucket.PutCopy(dstKey, s3.Private, options, src.bucket.Name+"/"+srcKey)
+	return err
+}
+
+// Objects smaller than one part are sent with a single PUT; anything larger is
+// sent as a multipart upload, one part at a time.
+func (this *S3Storage) NewWriter(key string, meta Metadata) (Writer, error) {
+	return &s3Writer{bucket: this.bucket, key: key, partSize: this.partSize, meta: meta}, nil
+}
+
+// Only multipart uploads can be resumed, so an object is never resumed part
+// way through its first part.  The parts recorded in state are checked
+// against those S3 still holds; if the upload has gone (for instance aborted
+// by a lifecycle rule) a new one is started, and if none of its parts can be
+// used it is aborted before starting a new one.  Other errors checking the
+// parts are returned, so that the caller keeps the state to try again.
+func (this *S3Storage) NewResumableWriter(key string, meta Metadata, state UploadState, checkpoint func(UploadState)) (Writer, int64, error) {
+	writer := &s3Writer{bucket: this.bucket, key: key, partSize: this.partSize, meta: meta, checkpoint: checkpoint}
+	if state.UploadID == "" {
+		return writer, 0, nil
+	}
+	multi := &s3.Multi{Bucket: this.bucket, Key: key, UploadId: state.UploadID}
+	stored, err := multi.ListParts()
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "NoSuchUpload" {
+		return writer, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	etags := make(map[int]string)
+	for _, part := range stored {
+		etags[part.N] = part.ETag
+	}
+	resumeAt := int64(0)
+	for i, part := range state.Parts {
+		if part.Number != i+1 || etags[part.Number] != part.ETag {
+			break
+		}
+		writer.parts = append(writer.parts, s3.Part{N: part.Number, ETag: part.ETag, Size: part.Size})
+		resumeAt += part.Size
+	}
+	if len(writer.parts) > 0 {
+		writer.multi = multi
+	} else if err = multi.Abort(); err != nil {
+		return nil, 0, err
+	}
+	return writer, resumeAt, nil
+}
+
+func (this *S3Storage) AbortUpload(key string, state UploadState) error {
+	if state.UploadID == "" {
+		return nil
+	}
+	multi := &s3.Multi{Bucket: this.bucket, Key: key, UploadId: state.UploadID}
+	err := multi.Abort()
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "NoSuchUpload" {
+		return nil
+	}
+	return err
+}
+
+func (this *s3Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		room := int(this.partSize) - len(this.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		this.buf = append(this.buf, p[:room]...)
+		p = p[room:]
+		n += room
+		if int64(len(this.buf)) == this.partSize {
+			if err = this.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (this *s3Writer) Close() error {
+	if this.multi == nil {
+		return this.bucket.Put(this.key, this.buf, "application/octet-stream", s3.Private, this.options())
+	}
+	if len(this.buf) > 0 {
+		if err := this.flush(); err != nil {
+			return err
+		}
+	}
+	return this.multi.Complete(this.parts)
+}
+
+func (this *s3Writer) Abort() error {
+	this.buf = nil
+	if this.multi == nil {
+		return nil
+	}
+	return this.multi.Abort()
+}
+
+// Sends the buffered data as the next part of the multipart upload
+func (this *s3Writer) flush() (err error) {
+	if this.multi == nil {
+		this.multi, err = this.bucket.InitMulti(this.key, "application/octet-stream", s3.Private, this.options())
+		if err != nil {
+			return
+		}
+	}
+	part, err := this.multi.PutPart(len(this.parts)+1, bytes.NewReader(this.buf))
+	if err != nil {
+		return
+	}
+	this.parts = append(this.parts, part)
+	this.buf = this.buf[:0]
+	if this.checkpoint != nil {
+		state := UploadState{UploadID: this.multi.UploadId}
+		for _, part := range this.parts {
+			state.Parts = append(state.Parts, UploadPart{part.N, part.ETag, part.Size})
+		}
+		this.checkpoint(state)
+	}
+	return
+}
+
+func (this *s3Writer) options() s3.Options {
+	options := s3.Options{}
+	if len(this.meta) > 0 {
+		options.Meta = make(map[string][]string)
+		for k, v := range this.meta {
+			options.Meta[k] = []string{v}
+		}
+	}
+	return options
+}
+
+// Extracts the x-amz-meta-* headers of a response
+func metaFromHeader(header http.Header) Metadata {
+	meta := make(Metadata)
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, metaHeaderPrefix) && len(v) > 0 {
+			meta[strings.TrimPrefix(k, metaHeaderPrefix)] = v[0]
+		}
+	}
+	return meta
+}
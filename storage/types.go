@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"github.com/opslabjpl/goamz/s3"
+	"io"
+	"os"
+	"time"
+)
+
+// Storage is the interface every remote backend implements.  Keys are
+// slash-separated paths relative to the root of the backend (the bucket for
+// S3, the base directory for local storage).
+type Storage interface {
+	// Lists every object whose key starts with prefix
+	List(prefix string) ([]Object, error)
+	// Lists the immediate "sub-directories" under prefix, each ending in "/"
+	ListChildren(prefix string) ([]string, error)
+	Stat(key string) (Object, error)
+	Exists(key string) (bool, error)
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Delete(key string) error
+	// Streams an object along with the metadata it was written with
+	NewReader(key string) (io.ReadCloser, Metadata, error)
+	NewWriter(key string, meta Metadata) (Writer, error)
+	// Like NewWriter, but the upload survives the process: checkpoint is
+	// called with the upload's state whenever more of the object has been
+	// stored durably, and passing that state back in a later process resumes
+	// the upload.  The caller must then skip the first resumeAt bytes of the
+	// object, which may be fewer than the state records if the backend has
+	// lost the upload.  Abort discards the upload; to keep it for resuming,
+	// just stop writing.
+	NewResumableWriter(key string, meta Metadata, state UploadState, checkpoint func(UploadState)) (w Writer, resumeAt int64, err error)
+	// Discards an upload left unfinished by NewResumableWriter, given its last
+	// checkpointed state.  An upload the backend no longer has is not an error.
+	AbortUpload(key string, state UploadState) error
+	// Streams an object from the given byte offset onwards
+	NewRangeReader(key string, offset int64) (io.ReadCloser, Metadata, error)
+	// Replaces the metadata of an existing object without rewriting its data
+	SetMeta(key string, meta Metadata) error
+	// Identifies where the objects are kept, such as a bucket or directory
+	Location() string
+}
+
+// User-defined key/value pairs stored alongside an object.  Keys should be
+// lowercase since S3 does not preserve their case.
+type Metadata map[string]string
+
+// A Writer streams data to a single object.  The object only becomes visible
+// once Close returns successfully; Abort discards everything written so far.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Enough about an unfinished upload to resume it
+type UploadState struct {
+	// Identifies the upload to the backend; empty until it has started
+	UploadID string       `json:"upload_id,omitempty"`
+	Parts    []UploadPart `json:"parts,omitempty"`
+}
+
+type UploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Only filled in by Stat; listings do not return metadata
+	Meta Metadata
+}
+
+// Storage backed by an S3 bucket
+type S3Storage struct {
+	bucket   *s3.Bucket
+	partSize int64
+}
+
+// Storage backed by a plain (possibly network mounted) directory
+type LocalStorage struct {
+	root string
+}
+
+type s3Writer struct {
+	bucket   *s3.Bucket
+	key      string
+	partSize int64
+	meta     Metadata
+	buf      []byte
+	multi    *s3.Multi
+	parts    []s3.Part
+	// Called after each part when the upload is resumable
+	checkpoint func(UploadState)
+}
+
+type localWriter struct {
+	file *os.File
+	path string
+	meta Metadata
+}
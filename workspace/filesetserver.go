@@ -0,0 +1,201 @@
+package workspace
+
+import (
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Directories are listed as HTML, files are served with support for Range
+// and conditional requests.  Symlinks are followed within the fileset.
+func (this *FilesetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, entry := this.lookup(r.URL.Path)
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if entry.Mode.IsDir() || entry == this.fileSet.Root {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, (&url.URL{Path: r.URL.Path + "/"}).String(), http.StatusMovedPermanently)
+			return
+		}
+		this.serveDir(w, r, entry)
+		return
+	}
+
+	var content io.ReadSeeker = strings.NewReader("")
+	if entry.Size > 0 {
+		cached, err := this.fetch(entry)
+		if err != nil {
+			log.Printf("Unable to fetch %s: %s", name, err)
+			http.Error(w, "Unable to fetch "+name, http.StatusBadGateway)
+			return
+		}
+		f, err := os.Open(cached)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		content = f
+	}
+	http.ServeContent(w, r, path.Base(name), entry.ModTime, content)
+}
+
+// Returns the entry at the slash-separated path name, following symlinks,
+// along with the path it was found at.  The entry is nil if there is none or
+// a symlink leads outside the fileset.
+func (this *FilesetServer) lookup(name string) (string, *fileset.Entry) {
+	for hops := 0; hops <= maxSymlinkHops; hops++ {
+		parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+		entry := this.fileSet.Root
+		followed := false
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			if entry = entry.Tree[part]; entry == nil {
+				return name, nil
+			}
+			if entry.Target != "" {
+				target := path.Join(path.Join(parts[:i]...), entry.Target)
+				if path.IsAbs(entry.Target) || target == ".." || strings.HasPrefix(target, "../") {
+					return name, nil
+				}
+				name = path.Join(target, path.Join(parts[i+1:]...))
+				followed = true
+				break
+			}
+		}
+		if !followed {
+			return name, entry
+		}
+	}
+	return name, nil
+}
+
+func (this *FilesetServer) serveDir(w http.ResponseWriter, r *http.Request, dir *fileset.Entry) {
+	names := make([]string, 0, len(dir.Tree))
+	for name, _ := range dir.Tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	title := html.EscapeString(r.URL.Path)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n<pre>\n", title, title)
+	if r.URL.Path != "/" {
+		fmt.Fprintln(w, `<a href="../">../</a>`)
+	}
+	for _, name := range names {
+		entry := dir.Tree[name]
+		if entry.Mode.IsDir() {
+			name += "/"
+		}
+		padding := 1
+		if len(name) < 50 {
+			padding = 50 - len(name)
+		}
+		link := (&url.URL{Path: name}).String()
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>%s %s %12d\n", link, html.EscapeString(name),
+			strings.Repeat(" ", padding), entry.ModTime.Format("2006-01-02 15:04"), entry.Size)
+	}
+	fmt.Fprintln(w, "</pre>\n</body></html>")
+}
+
+// Returns the path of the cached copy of the file, downloading it (or its
+// chunks) first if there isn't one yet.  A copy that was already cached is
+// checked against its digest the first time it is served, and fetched again
+// if it doesn't match.
+func (this *FilesetServer) fetch(entry *fileset.Entry) (cached string, err error) {
+	lock := this.lock(entry.Digest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cached = filepath.Join(this.cacheDir, entry.Digest)
+	this.mutex.Lock()
+	verified := this.verified[entry.Digest]
+	this.mutex.Unlock()
+	if verified {
+		return cached, nil
+	}
+	defer func() {
+		if err == nil {
+			this.mutex.Lock()
+			this.verified[entry.Digest] = true
+			this.mutex.Unlock()
+		}
+	}()
+	if _, err := os.Stat(cached); err == nil {
+		actual, err := hashSection(cached, 0, -1)
+		if err == nil && actual == entry.Digest {
+			return cached, nil
+		}
+		log.Printf("Cached copy of %s is corrupt, fetching it again", entry.Digest)
+		os.Remove(cached)
+	}
+	if len(entry.Chunks) == 0 {
+		return cached, this.download(entry.Digest)
+	}
+	// Chunks are left in the cache, since other files may share them
+	for _, chunk := range entry.Chunks {
+		if _, err := os.Stat(filepath.Join(this.cacheDir, chunk.Digest)); err == nil {
+			continue
+		}
+		chunkLock := this.lock(chunk.Digest)
+		chunkLock.Lock()
+		err := this.download(chunk.Digest)
+		chunkLock.Unlock()
+		if err != nil {
+			return "", err
+		}
+	}
+	return cached, assembleFile(this.cacheDir, entry.Digest, entry.Chunks)
+}
+
+// Downloads the blob with the given digest into the cache, checking it
+// against the digest
+func (this *FilesetServer) download(digest string) error {
+	cached := filepath.Join(this.cacheDir, digest)
+	if _, err := os.Stat(cached); err == nil {
+		return nil
+	}
+	log.Printf("Fetching %s", digest)
+	err := this.remote.DownloadFile(cached, digest)
+	if err == nil {
+		var actual string
+		if actual, err = hashSection(cached, 0, -1); err == nil && actual != digest {
+			err = fmt.Errorf("%s content hashes to %s", digest, actual)
+		}
+	}
+	if err != nil {
+		os.Remove(cached)
+	}
+	return err
+}
+
+// Returns the mutex held while the blob with the given digest is fetched
+func (this *FilesetServer) lock(digest string) *sync.Mutex {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	lock := this.fetching[digest]
+	if lock == nil {
+		lock = new(sync.Mutex)
+		this.fetching[digest] = lock
+	}
+	return lock
+}
@@ -0,0 +1,34 @@
+package workspace
+
+import (
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"os"
+	"testing"
+)
+
+func TestFilesetServer_Lookup(t *testing.T) {
+	file := &fileset.Entry{Mode: 0644, Size: 4, Digest: "0123"}
+	fileSet := &fileset.FileSet{Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{
+		"dir": &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{
+			"up":      &fileset.Entry{Mode: os.ModeSymlink | 0777, Target: "../file"},
+			"escape":  &fileset.Entry{Mode: os.ModeSymlink | 0777, Target: "../../file"},
+			"further": &fileset.Entry{Mode: os.ModeSymlink | 0777, Target: "../../../../dir/up"},
+			"abs":     &fileset.Entry{Mode: os.ModeSymlink | 0777, Target: "/file"},
+		}},
+		"file": file,
+	}}}
+	server := NewFilesetServer(nil, fileSet, "")
+
+	for name, want := range map[string]*fileset.Entry{
+		"/file":        file,
+		"/dir/up":      file,
+		"/dir/escape":  nil,
+		"/dir/further": nil,
+		"/dir/abs":     nil,
+		"/missing":     nil,
+	} {
+		if _, entry := server.lookup(name); entry != want {
+			t.Errorf("%s resolved to %+v", name, entry)
+		}
+	}
+}
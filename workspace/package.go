@@ -1,19 +1,100 @@
 package workspace
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/workspace/remote"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const EarthkitDir = ".earthkit"
 
+// Patterns (in gitignore syntax) of paths to leave out of filesets, read from
+// the root of the workspace and from the user's home directory
+const IgnoreFile = ".earthkitignore"
+
+// Suffix of files that are still being written
+const partialSuffix = ".partial"
+
+// Symlinks followed when resolving a path served by a FilesetServer
+const maxSymlinkHops = 8
+
+// Names of the entries in a bundle
+const (
+	bundleInfoName    = "bundle.json"
+	bundleFilesetsDir = "filesets/"
+	bundleFilesDir    = "files/"
+)
+
+// Uploads the blobs a fileset needs and then publishes the fileset itself,
+// calling check under the publish lock to refuse it if need be.  A push lock
+// holds off gc until the fileset referencing the blobs is written, since
+// blobs skipped because they already exist would otherwise be fair game.  The
+// locks are released before returning, whether or not the upload succeeded.
+func uploadFileset(remoteWs *remote.Remote, filesetName string, fileSet *fileset.FileSet, data []byte, blobs []remote.Blob, check func() error) error {
+	release, err := remoteWs.Lock("push")
+	if err != nil {
+		return err
+	}
+	defer release()
+	remoteWs.AbortOtherUploads(blobs)
+	if err = remoteWs.UploadBlobs(blobs); err != nil {
+		return err
+	}
+	return remoteWs.PublishFileset(filesetName, fileSet, data, check)
+}
+
+// Returns a check for uploadFileset that refuses to overwrite an existing
+// fileset, with hint telling the user what to do instead
+func refuseExisting(remoteWs *remote.Remote, filesetName string, hint string) func() error {
+	return func() error {
+		exists, err := remoteWs.FilesetExists(filesetName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("Fileset %s already exists. %s", filesetName, hint)
+		}
+		return nil
+	}
+}
+
+// Removes everything under relDir except the paths the rules ignore, returning
+// whether anything was kept
+func wipe(rootDir string, relDir string, rules fileset.IgnoreRules) (kept bool) {
+	infos, err := ioutil.ReadDir(filepath.Join(rootDir, relDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, info := range infos {
+		relPath := filepath.Join(relDir, info.Name())
+		switch {
+		case rules.Ignored(relPath, info.IsDir()):
+			kept = true
+		case info.IsDir() && wipe(rootDir, relPath, rules):
+			kept = true
+		default:
+			os.RemoveAll(filepath.Join(rootDir, relPath))
+		}
+	}
+	return
+}
+
 // Starting at the given dir, traverse up to the root dir
 // and generate a Workspace struct
 func GetWorkspace(dir string) (workspace Workspace) {
@@ -39,6 +120,10 @@ func New(name, dir string) *Workspace {
 	return &Workspace{name, dir, nil, []string{}}
 }
 
+func NewFilesetServer(remoteWs *remote.Remote, fileSet *fileset.FileSet, cacheDir string) *FilesetServer {
+	return &FilesetServer{remote: remoteWs, fileSet: fileSet, cacheDir: cacheDir, fetching: make(map[string]*sync.Mutex), verified: make(map[string]bool)}
+}
+
 // Traverse up the tree, loking for earthkitrc
 func findEarthkitRC(dir string) (earthKitRC string, rootDir string) {
 	earthKitRC = filepath.Join(dir, EarthkitDir, "earthkitrc")
@@ -115,6 +200,57 @@ func genDigest(path string) (digest string) {
 	return
 }
 
+// Returns the digest of size bytes of the file starting at offset, or of the
+// whole file if size is negative
+func hashSection(path string, offset int64, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.NewSectionReader(f, offset, size)
+	}
+	return fileset.Hexdigest(r)
+}
+
+// Returns the first of the candidate local copies of a blob whose content
+// still matches its digest
+func goodSource(candidates []remote.Blob) *remote.Blob {
+	for i, blob := range candidates {
+		if digest, err := hashSection(blob.Path, blob.Offset, blob.Size); err == nil && digest == blob.Digest {
+			return &candidates[i]
+		}
+	}
+	return nil
+}
+
+// Computes the chunks of every large file in the fileset that doesn't have
+// them yet (files whose chunks were reused from the cached fileset do).
+func chunkFiles(baseDir string, fileSet *fileset.FileSet) {
+	walkFn := func(fullPath string, entry *fileset.Entry) error {
+		if !entry.Mode.IsRegular() || entry.Size < fileset.ChunkedFileSize || len(entry.Chunks) > 0 {
+			return nil
+		}
+		chunks, err := fileset.ChunkFile(filepath.Join(baseDir, fullPath))
+		if err != nil {
+			log.Fatal(err)
+		}
+		entry.Chunks = chunks
+		return nil
+	}
+	fileSet.Root.Walk(walkFn)
+}
+
+// Returns the name of the user running earthkit, for recording in filesets
+func currentAuthor() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
 func genEtcdDiscoveryURL(newUrl string) []byte {
 	resp, err := http.Get(newUrl)
 	if err != nil {
@@ -140,3 +276,276 @@ func (f filesDateSort) Less(i, j int) bool {
 func (f filesDateSort) Swap(i, j int) {
 	f[i], f[j] = f[j], f[i]
 }
+
+// Writes a bundle holding the fileset manifest data and the given blobs,
+// keyed by digest
+func writeBundle(w io.Writer, info *BundleInfo, data []byte, blobs map[string]remote.Blob) error {
+	tw := tar.NewWriter(w)
+	infoData, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeBundleEntry(tw, bundleInfoName, bytes.NewReader(infoData), int64(len(infoData))); err != nil {
+		return err
+	}
+	if err = writeBundleEntry(tw, bundleFilesetsDir+info.Fileset+".json.gz", bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	digests := make([]string, 0, len(blobs))
+	for digest, _ := range blobs {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		blob := blobs[digest]
+		f, err := os.Open(blob.Path)
+		if err != nil {
+			return err
+		}
+		size := blob.Size
+		if size < 0 {
+			var fi os.FileInfo
+			if fi, err = f.Stat(); err == nil {
+				size = fi.Size()
+			}
+		}
+		if err == nil {
+			err = writeBundleEntry(tw, bundleFilesDir+digest, io.NewSectionReader(f, blob.Offset, size), size)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeBundleEntry(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// Reads a bundle written by writeBundle, extracting its blobs into files in
+// dir named after their digests and checking them against those digests
+func readBundle(r io.Reader, dir string) (info *BundleInfo, data []byte, digests []string, err error) {
+	tr := tar.NewReader(r)
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		switch {
+		case header.Name == bundleInfoName:
+			info = new(BundleInfo)
+			// The name is used for the cache file and the remote key
+			if err = json.NewDecoder(tr).Decode(info); err == nil {
+				err = remote.CheckFilesetName(info.Fileset)
+			}
+		case info == nil:
+			err = fmt.Errorf("%s is not the first entry", bundleInfoName)
+		case strings.HasPrefix(header.Name, bundleFilesetsDir):
+			data, err = ioutil.ReadAll(tr)
+		case strings.HasPrefix(header.Name, bundleFilesDir):
+			digest := strings.TrimPrefix(header.Name, bundleFilesDir)
+			if digest == "" || strings.ContainsAny(digest, "/.") {
+				err = fmt.Errorf("unexpected entry %s", header.Name)
+				break
+			}
+			err = extractBlob(tr, filepath.Join(dir, digest), digest)
+			digests = append(digests, digest)
+		default:
+			err = fmt.Errorf("unexpected entry %s", header.Name)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if info == nil || data == nil {
+		err = fmt.Errorf("no fileset manifest")
+	}
+	return
+}
+
+// Writes r to the file at path, failing if its content doesn't hash to digest
+func extractBlob(r io.Reader, path string, digest string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != digest {
+		err = fmt.Errorf("%s does not match its digest", digest)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Makes sure cacheDir holds the content of every file in entryMap, named
+// after its digest, downloading whatever isn't there yet
+func fetchDigests(remoteWs *remote.Remote, cacheDir string, entryMap fileset.EntryMap) {
+	if _, err := os.Stat(cacheDir); err != nil {
+		os.MkdirAll(cacheDir, 0700)
+	}
+
+	// Get list of digest to download.  Chunked files that aren't cached yet
+	// need their chunks, which are reassembled once downloaded.
+	digestSet := make(map[string]bool)
+	chunked := make(map[string][]fileset.Chunk)
+	whole := make(map[string]bool)
+	for _, entry := range entryMap {
+		if entry.Digest == "" {
+			continue
+		}
+		if len(entry.Chunks) == 0 {
+			whole[entry.Digest] = true
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, entry.Digest)); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			if len(entry.Chunks) == 0 {
+				digestSet[entry.Digest] = true
+				continue
+			}
+			chunked[entry.Digest] = entry.Chunks
+			for _, chunk := range entry.Chunks {
+				if _, err := os.Stat(filepath.Join(cacheDir, chunk.Digest)); os.IsNotExist(err) {
+					digestSet[chunk.Digest] = true
+				}
+			}
+		}
+	}
+	// Convert the set to a flat array
+	digests := make([]string, len(digestSet))
+	i := 0
+	for digest, _ := range digestSet {
+		digests[i] = digest
+		i++
+	}
+	// download the needed digests files
+	remoteWs.Download(cacheDir, digests)
+
+	if len(chunked) > 0 {
+		assembleChunks(cacheDir, chunked)
+		// Chunks are only needed until their files have been assembled
+		for digest, _ := range digestSet {
+			if _, isFile := chunked[digest]; !isFile && !whole[digest] {
+				os.Remove(filepath.Join(cacheDir, digest))
+			}
+		}
+	}
+}
+
+// Recreates the entries of entryMap under rootDir, moving file contents out
+// of cacheDir (or copying them, if another entry already took the cached
+// copy).  Modes and mtimes are applied once everything has been created, so
+// that read-only directories can still be filled and creating entries
+// doesn't disturb their parents' mtimes.
+func rebuild(rootDir string, cacheDir string, entryMap fileset.EntryMap) {
+	// This map is used for keeping track of digest file that has been moved
+	// from cache to final workspace
+	movedDigestMap := make(map[string]string)
+
+	// Need to sort the entries since we need to create parent dirs first before
+	// creating children entries
+	keys := make([]string, len(entryMap))
+	i := 0
+	for k, _ := range entryMap {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path := filepath.Join(rootDir, k)
+		entry := entryMap[k]
+		if entry.Mode.IsDir() {
+			os.MkdirAll(path, 0755)
+		} else if entry.Target != "" {
+			os.Symlink(entry.Target, path)
+		} else {
+			srcFile := filepath.Join(cacheDir, entry.Digest)
+
+			// empty file. Just create
+			if entry.Size == 0 {
+				if f, err := os.Create(path); err == nil {
+					f.Close()
+				}
+				// if src file doesn't exist, it's because we already
+				// move it for another file. Let's just copy it then
+			} else if _, err := os.Stat(srcFile); os.IsNotExist(err) {
+				cp(movedDigestMap[srcFile], path)
+			} else {
+				os.Rename(srcFile, path)
+				movedDigestMap[srcFile] = path
+			}
+			os.Chmod(path, entry.Mode)
+		}
+	}
+
+	for k, entry := range entryMap {
+		if entry.Mode.IsRegular() {
+			if err := os.Chtimes(filepath.Join(rootDir, k), entry.ModTime, entry.ModTime); err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+	}
+	// Deepest directories first, so that setting a child's mode and mtime
+	// can't fail for lack of permission on its parent
+	for i := len(keys) - 1; i >= 0; i-- {
+		entry := entryMap[keys[i]]
+		if !entry.Mode.IsDir() {
+			continue
+		}
+		path := filepath.Join(rootDir, keys[i])
+		os.Chmod(path, entry.Mode)
+		if !entry.ModTime.IsZero() {
+			os.Chtimes(path, entry.ModTime, entry.ModTime)
+		}
+	}
+}
+
+// Concatenates the cached chunks of a file into a cached file named after
+// fileDigest, failing if the result doesn't match it
+func assembleFile(cacheDir string, fileDigest string, chunks []fileset.Chunk) error {
+	tmp, err := ioutil.TempFile(cacheDir, fileDigest+partialSuffix)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	dst := io.MultiWriter(tmp, hash)
+	for _, chunk := range chunks {
+		var src *os.File
+		if src, err = os.Open(filepath.Join(cacheDir, chunk.Digest)); err != nil {
+			break
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			break
+		}
+	}
+	tmp.Close()
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != fileDigest {
+		err = fmt.Errorf("Reassembled file does not match its digest %s", fileDigest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(cacheDir, fileDigest))
+}
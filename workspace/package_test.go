@@ -0,0 +1,116 @@
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Pulled entries get the modes and mtimes recorded in the fileset, including
+// directories that are only made read-only once their contents are in place
+func TestRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthkit-rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootDir := filepath.Join(dir, "root")
+	cacheDir := filepath.Join(dir, "cache")
+	os.Mkdir(rootDir, 0755)
+	os.Mkdir(cacheDir, 0700)
+	ioutil.WriteFile(filepath.Join(cacheDir, "0123"), []byte("data"), 0600)
+
+	dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileTime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	entryMap := fileset.EntryMap{
+		"ro":         &fileset.Entry{Mode: os.ModeDir | 0555, ModTime: dirTime},
+		"ro/sub":     &fileset.Entry{Mode: os.ModeDir | 0750, ModTime: dirTime},
+		"ro/sub/f":   &fileset.Entry{Mode: 0640, ModTime: fileTime, Size: 4, Digest: "0123"},
+		"ro/sub/dup": &fileset.Entry{Mode: 0755, ModTime: fileTime, Size: 4, Digest: "0123"},
+		"ro/empty":   &fileset.Entry{Mode: 0600, ModTime: fileTime},
+		"link":       &fileset.Entry{Mode: os.ModeSymlink | 0777, Target: "ro/sub/f"},
+	}
+	rebuild(rootDir, cacheDir, entryMap)
+	// Let the cleanup remove the read-only directory
+	defer os.Chmod(filepath.Join(rootDir, "ro"), 0755)
+
+	for relPath, entry := range entryMap {
+		info, err := os.Lstat(filepath.Join(rootDir, relPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != entry.Mode {
+			t.Errorf("%s has mode %s, want %s", relPath, info.Mode(), entry.Mode)
+		}
+		if entry.Target == "" && !info.ModTime().Equal(entry.ModTime) {
+			t.Errorf("%s has mtime %s, want %s", relPath, info.ModTime(), entry.ModTime)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(rootDir, "link")); err != nil || target != "ro/sub/f" {
+		t.Errorf("link points to %q (%v)", target, err)
+	}
+	for _, relPath := range []string{"ro/sub/f", "ro/sub/dup"} {
+		if data, err := ioutil.ReadFile(filepath.Join(rootDir, relPath)); err != nil || string(data) != "data" {
+			t.Errorf("%s contains %q (%v)", relPath, data, err)
+		}
+	}
+}
+
+// A bundle naming its fileset with a path that would escape the cache or the
+// remote prefix is refused before any of its entries are extracted
+func TestReadBundleRejectsBadName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthkit-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blob := []byte("data")
+	sum := sha256.Sum256(blob)
+	digest := hex.EncodeToString(sum[:])
+	manifest := []byte("{}")
+
+	for _, name := range []string{"good", "", "../../evil", "a/b", "a\\b", ".."} {
+		extractDir := filepath.Join(dir, "extract")
+		os.RemoveAll(extractDir)
+		os.Mkdir(extractDir, 0700)
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		info, _ := json.Marshal(BundleInfo{Workspace: "ws", Fileset: name})
+		for _, entry := range []struct {
+			name string
+			data []byte
+		}{
+			{bundleInfoName, info},
+			{bundleFilesetsDir + "fileset.json", manifest},
+			{bundleFilesDir + digest, blob},
+		} {
+			if err := writeBundleEntry(tw, entry.name, bytes.NewReader(entry.data), int64(len(entry.data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+
+		_, _, _, err := readBundle(&buf, extractDir)
+		entries, _ := ioutil.ReadDir(extractDir)
+		if name == "good" {
+			if err != nil || len(entries) != 1 {
+				t.Errorf("valid bundle gave %v with %d entries extracted", err, len(entries))
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("bundle with fileset name %q was accepted", name)
+		}
+		if len(entries) != 0 {
+			t.Errorf("bundle with fileset name %q extracted %d entries", name, len(entries))
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package remote
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+func (this *inventory) save(path string) error {
+	this.Digests = make([]string, 0, len(this.digests))
+	for digest, _ := range this.digests {
+		this.Digests = append(this.Digests, digest)
+	}
+	sort.Strings(this.Digests)
+	data, err := json.Marshal(this)
+	this.Digests = nil
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,81 @@
+package remote
+
+import (
+	"encoding/json"
+	"github.com/opslabjpl/earthkit-cli/storage"
+	"io/ioutil"
+	"os"
+)
+
+// Returns the upload recorded for key, or nil
+func (this *Journal) upload(key string) *journalUpload {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.Uploads[key]
+}
+
+func (this *Journal) putUpload(key string, meta storage.Metadata, state storage.UploadState) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Uploads[key] = &journalUpload{meta, state}
+	return this.save()
+}
+
+func (this *Journal) removeUpload(key string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.Uploads[key] == nil {
+		return nil
+	}
+	delete(this.Uploads, key)
+	return this.save()
+}
+
+// Returns the keys of every upload recorded
+func (this *Journal) uploadKeys() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	keys := make([]string, 0, len(this.Uploads))
+	for key := range this.Uploads {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Returns the download recorded for key, or nil
+func (this *Journal) download(key string) *journalDownload {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.Downloads[key]
+}
+
+func (this *Journal) putDownload(key string, object storage.Object) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Downloads[key] = &journalDownload{object.Size, object.LastModified}
+	return this.save()
+}
+
+func (this *Journal) removeDownload(key string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.Downloads[key] == nil {
+		return nil
+	}
+	delete(this.Downloads, key)
+	return this.save()
+}
+
+// Writes the journal out atomically, so a crash never leaves it truncated.
+// Must be called with the mutex held.
+func (this *Journal) save() error {
+	data, err := json.Marshal(this)
+	if err != nil {
+		return err
+	}
+	tmp := this.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, this.path)
+}
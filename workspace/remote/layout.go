@@ -0,0 +1,120 @@
+package remote
+
+import (
+	"path"
+)
+
+// Returns the prefix under which all workspaces are stored, ending in "/"
+// unless the layout has an empty prefix.
+func (this Layout) Root() string {
+	if this.prefix == "" {
+		return ""
+	}
+	return this.prefix + "/"
+}
+
+func (this Layout) Prefix() string {
+	return this.prefix
+}
+
+func (this Layout) Workspace(workspace string) string {
+	return this.Root() + workspace + "/"
+}
+
+func (this Layout) Files(workspace string) string {
+	return this.Workspace(workspace) + "files/"
+}
+
+func (this Layout) Filesets(workspace string) string {
+	return this.Workspace(workspace) + "filesets/"
+}
+
+func (this Layout) File(workspace, digest string) string {
+	return this.Files(workspace) + digest
+}
+
+// Returns the key of a fileset manifest given the fileset name (without the
+// .json.gz extension)
+func (this Layout) Fileset(workspace, filesetName string) string {
+	return this.Filesets(workspace) + filesetName + ".json.gz"
+}
+
+// Summaries are small copies of each fileset's details, so that filesets can
+// be listed without fetching every manifest
+func (this Layout) Summaries(workspace string) string {
+	return this.Workspace(workspace) + "summaries/"
+}
+
+func (this Layout) Summary(workspace, filesetName string) string {
+	return this.Summaries(workspace) + filesetName + ".json"
+}
+
+func (this Layout) Refs(workspace string) string {
+	return this.Workspace(workspace) + "refs/"
+}
+
+func (this Layout) Ref(workspace, ref string) string {
+	return this.Refs(workspace) + ref
+}
+
+func (this Layout) DiscoveryURL(workspace string) string {
+	return path.Join(this.Workspace(workspace), "discovery_url")
+}
+
+func (this Layout) Encryption(workspace string) string {
+	return this.Workspace(workspace) + "encryption.json"
+}
+
+// Describes the new key of a key rotation in progress
+func (this Layout) PendingEncryption(workspace string) string {
+	return this.Workspace(workspace) + "encryption.pending.json"
+}
+
+func (this Layout) Locks(workspace string) string {
+	return this.Workspace(workspace) + "locks/"
+}
+
+// Rewritten whenever blobs may have been deleted, invalidating inventories
+// taken before
+func (this Layout) GCMarker(workspace string) string {
+	return this.Workspace(workspace) + "gc_marker"
+}
+
+func (this Layout) Info(workspace string) string {
+	return this.Workspace(workspace) + "workspace.json"
+}
+
+// The content store shared by workspaces, which sits beside them
+func (this Layout) Store() string {
+	return this.Root() + storeDir + "/"
+}
+
+func (this Layout) StoreFiles() string {
+	return this.Store() + "files/"
+}
+
+func (this Layout) StoreFile(digest string) string {
+	return this.StoreFiles() + digest
+}
+
+// Each workspace marks the blobs in the store it references with an empty
+// object under its own refs prefix
+func (this Layout) StoreRefs() string {
+	return this.Store() + "refs/"
+}
+
+func (this Layout) StoreWorkspaceRefs(workspace string) string {
+	return this.StoreRefs() + workspace + "/"
+}
+
+func (this Layout) StoreRef(workspace, digest string) string {
+	return this.StoreWorkspaceRefs(workspace) + digest
+}
+
+func (this Layout) StoreLocks() string {
+	return this.Store() + "locks/"
+}
+
+func (this Layout) StoreGCMarker() string {
+	return this.Store() + "gc_marker"
+}
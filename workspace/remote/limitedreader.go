@@ -0,0 +1,7 @@
+package remote
+
+func (this *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.limiter.wait(n)
+	return
+}
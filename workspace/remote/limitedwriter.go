@@ -0,0 +1,6 @@
+package remote
+
+func (this *limitedWriter) Write(p []byte) (int, error) {
+	this.limiter.wait(len(p))
+	return this.writer.Write(p)
+}
@@ -0,0 +1,5 @@
+package remote
+
+func (this *lockConflict) Error() string {
+	return this.what + " is locked by " + this.holder + "; try again later"
+}
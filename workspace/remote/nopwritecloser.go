@@ -0,0 +1,5 @@
+package remote
+
+func (this nopWriteCloser) Close() error {
+	return nil
+}
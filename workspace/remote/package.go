@@ -1,27 +1,418 @@
 package remote
 
 import (
-	"github.com/opslabjpl/goamz/s3"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opslabjpl/earthkit-cli/config"
+	"github.com/opslabjpl/earthkit-cli/envelope"
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/storage"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Metadata keys recording how a blob was compressed and encrypted
 const (
-	Prefix                  = ".earthkit/"
-	WorkspacePrefix         = ".earthkit/%s/"
-	WorkspaceFilesPrefix    = ".earthkit/%s/files/"
-	WorkspaceFilesetsPrefix = ".earthkit/%s/filesets/"
+	metaCompression = "compression"
+	metaEncryption  = "encryption"
+	metaDataKey     = "data-key"
+	metaKeyID       = "key-id"
 )
 
-func New(name string, bucket *s3.Bucket) *Remote {
-	return &Remote{name, bucket}
+// Locks older than this are assumed to have been left behind by a crashed
+// process and are ignored.  A held lock is rewritten every lockRefresh, so
+// only abandoned ones ever get this old.
+const StaleLockAge = time.Hour
+
+var lockRefresh = 5 * time.Minute
+
+// How long to wait between attempts to take a publish lock held by another
+// push, and how many attempts to make
+const (
+	publishRetryWait = 200 * time.Millisecond
+	publishAttempts  = 50
+)
+
+// Environment variables consulted before prompting for passphrases
+const (
+	passphraseEnv    = "EARTHKIT_PASSPHRASE"
+	newPassphraseEnv = "EARTHKIT_NEW_PASSPHRASE"
+)
+
+// Uploads of at least this many blobs take an inventory of the files prefix,
+// one listing request per thousand blobs, rather than checking each blob
+const inventoryMinBlobs = 1000
+
+// Suffix of the files downloads are written to until they are complete
+const partialSuffix = ".partial"
+
+// Name of the shared content store's prefix, which is not a workspace
+const storeDir = "_store"
+
+func summarize(filesetName string, fileSet *fileset.FileSet) *FilesetSummary {
+	return &FilesetSummary{
+		Name:    filesetName,
+		Size:    fileSet.Size,
+		Count:   fileSet.Count,
+		CrTime:  fileSet.CrTime,
+		Comment: fileSet.Comment,
+		Parent:  fileSet.Parent,
+		Author:  fileSet.Author,
+		Host:    fileSet.Host,
+	}
+}
+
+// Transfers are throttled according to the upload_limit and download_limit
+// options as they are when the Remote is created.
+func New(name string, store storage.Storage, layout Layout) *Remote {
+	return &Remote{
+		name:          name,
+		storage:       store,
+		layout:        layout,
+		sharedStore:   *config.SHARED_STORE,
+		uploadLimit:   newRateLimiter(*config.UPLOAD_LIMIT),
+		downloadLimit: newRateLimiter(*config.DOWNLOAD_LIMIT),
+	}
+}
+
+func NewLayout(prefix string) Layout {
+	return Layout{strings.Trim(prefix, "/")}
+}
+
+// Returns the layout for the s3_key_prefix given in .earthkitrc
+func DefaultLayout() Layout {
+	return NewLayout(*config.S3_KEY_PREFIX)
+}
+
+// Checks that name can be used for a fileset, which is stored under a key and
+// cached in a file named after it: it must not be empty, nor contain path
+// separators or ".."
+func CheckFilesetName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+		return fmt.Errorf("Invalid fileset name: %q", name)
+	}
+	return nil
+}
+
+// Loads the transfer journal kept at path, or starts an empty one if there
+// is none yet
+func OpenJournal(path string) (*Journal, error) {
+	journal := &Journal{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, journal)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if journal.Uploads == nil {
+		journal.Uploads = make(map[string]*journalUpload)
+	}
+	if journal.Downloads == nil {
+		journal.Downloads = make(map[string]*journalDownload)
+	}
+	return journal, nil
+}
+
+// Loads an inventory saved by inventory.save
+func loadInventory(path string) (*inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := new(inventory)
+	if err = json.Unmarshal(data, inv); err != nil {
+		return nil, err
+	}
+	inv.digests = make(map[string]bool, len(inv.Digests))
+	for _, digest := range inv.Digests {
+		inv.digests[digest] = true
+	}
+	inv.Digests = nil
+	return inv, nil
+}
+
+// Takes a lock of the given kind by writing an object under prefix.  The lock
+// is written before checking for conflicting locks, so of two processes
+// racing for conflicting locks at least one sees the other.  what names the
+// locked thing in errors.  The lock is kept fresh until release is called.
+func lock(store storage.Storage, prefix, what, kind string) (release func(), err error) {
+	host, _ := os.Hostname()
+	key := fmt.Sprintf("%s%s-%s-%d-%d", prefix, kind, host, os.Getpid(), time.Now().UnixNano())
+	if err = store.Put(key, []byte{}); err != nil {
+		return
+	}
+
+	// The mutex keeps a refresh from recreating the lock after its release
+	var mutex sync.Mutex
+	released := false
+	done := make(chan bool)
+	release = func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !released {
+			released = true
+			close(done)
+			store.Delete(key)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mutex.Lock()
+				if !released {
+					if err := store.Put(key, []byte{}); err != nil {
+						log.Printf("Unable to refresh lock %s: %s", path.Base(key), err)
+					}
+				}
+				mutex.Unlock()
+			}
+		}
+	}()
+
+	locks, err := store.List(prefix)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	for _, lock := range locks {
+		if lock.Key == key || time.Since(lock.LastModified) > StaleLockAge {
+			continue
+		}
+		other := strings.SplitN(path.Base(lock.Key), "-", 2)[0]
+		if kind == "gc" || other == "gc" || (kind == "publish" && other == "publish") {
+			release()
+			return nil, &lockConflict{what, path.Base(lock.Key)}
+		}
+	}
+	return release, nil
 }
 
-func Workspaces(bucket *s3.Bucket) ([]string, error) {
+func Workspaces(store storage.Storage, layout Layout) ([]string, error) {
 	workspaces := make([]string, 0, 256)
-	prefixes, errs := bucket.ListAllChildrenAsync(Prefix, "/")
-	for prefix := range prefixes {
-		workspaces = append(workspaces, path.Base(prefix))
+	prefixes, err := store.ListChildren(layout.Root())
+	for _, prefix := range prefixes {
+		if path.Base(prefix) != storeDir {
+			workspaces = append(workspaces, path.Base(prefix))
+		}
 	}
-	err := <-errs
 	return workspaces, err
 }
+
+// Runs fn on every transfer using up to the configured number of goroutines.
+// Once a transfer fails no new ones are started, and the first error is
+// returned.
+func runTransfers(transfers []transfer, fn func(transfer) error) error {
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	workers := *config.TRANSFERS
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan transfer, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed {
+					continue
+				}
+				if err := fn(t); err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, t := range transfers {
+		queue <- t
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// Returns a limiter allowing rate bytes per second, or nil (no limit) if
+// rate isn't positive
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// Returns the compression to use for a blob read from the given file, or an
+// empty string if it should be stored as is.  Files that are already
+// compressed (according to compression_skip) are never compressed again.
+func compressionFor(fileName string) string {
+	if *config.COMPRESSION == "" || *config.COMPRESSION == "none" {
+		return ""
+	}
+	ext := strings.ToLower(path.Ext(fileName))
+	for _, skip := range strings.Split(*config.COMPRESSION_SKIP, ",") {
+		if ext != "" && ext == strings.ToLower(strings.TrimSpace(skip)) {
+			return ""
+		}
+	}
+	return *config.COMPRESSION
+}
+
+// Wraps w so that everything written is compressed.  Closing the returned
+// writer flushes the compressor but does not close w.
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("Unsupported compression: %s", compression)
+}
+
+// Wraps r so that reading from it returns the decompressed data
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression: %s", compression)
+}
+
+// Wraps w so that everything written is encrypted with the data key.  A nil
+// data key means the workspace is not encrypted.  Closing the returned writer
+// does not close w.
+func encryptWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	if dataKey == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return envelope.NewWriter(w, dataKey)
+}
+
+// Obtains the key described by doc, from the key file or a passphrase
+func loadKey(doc *encryptionDoc) (*envelope.Key, error) {
+	if doc.KDF == "keyfile" && *config.ENCRYPTION_KEY_FILE == "" {
+		return nil, fmt.Errorf("This workspace is encrypted; set encryption_key_file in .earthkitrc")
+	}
+	return keyFor(doc, *config.ENCRYPTION_KEY_FILE, passphraseEnv, "Workspace passphrase: ")
+}
+
+// Obtains the key described by doc from keyFile, or from a passphrase read
+// from envVar or the terminal
+func keyFor(doc *encryptionDoc, keyFile string, envVar string, prompt string) (*envelope.Key, error) {
+	var (
+		key *envelope.Key
+		err error
+	)
+	switch doc.KDF {
+	case "keyfile":
+		if keyFile == "" {
+			return nil, fmt.Errorf("Key %s is read from a key file, but none was given", doc.KeyID)
+		}
+		key, err = envelope.LoadKeyFile(keyFile)
+	case "scrypt":
+		var passphrase string
+		passphrase, err = readPassphrase(envVar, prompt)
+		if err == nil {
+			key, err = envelope.DeriveKey(passphrase, doc.Salt)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation: %s", doc.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.ID != doc.KeyID {
+		return nil, fmt.Errorf("Wrong encryption key for this workspace (expected key %s, got %s)", doc.KeyID, key.ID)
+	}
+	return key, nil
+}
+
+// Creates a new key, read from (or generated into) keyFile, or derived from a
+// new passphrase if keyFile is empty
+func newKey(keyFile string, envVar string) (*envelope.Key, *encryptionDoc, error) {
+	if keyFile != "" {
+		key, err := envelope.LoadKeyFile(keyFile)
+		if os.IsNotExist(err) {
+			fmt.Println("Generating new key file", keyFile)
+			key, err = envelope.GenerateKeyFile(keyFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &encryptionDoc{KDF: "keyfile", KeyID: key.ID}, nil
+	}
+
+	passphrase, err := readPassphrase(envVar, "New passphrase: ")
+	if err != nil {
+		return nil, nil, err
+	}
+	if os.Getenv(envVar) == "" {
+		confirmation, err := readPassphrase(envVar, "Repeat passphrase: ")
+		if err != nil {
+			return nil, nil, err
+		}
+		if confirmation != passphrase {
+			return nil, nil, fmt.Errorf("Passphrases do not match")
+		}
+	}
+	salt, err := envelope.NewSalt()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := envelope.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &encryptionDoc{KDF: "scrypt", Salt: salt, KeyID: key.ID}, nil
+}
+
+// Reads a passphrase from the environment variable, or from the terminal
+// without echoing it
+func readPassphrase(envVar string, prompt string) (string, error) {
+	if passphrase := os.Getenv(envVar); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Print(prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err == nil && len(passphrase) == 0 {
+		err = fmt.Errorf("Empty passphrase")
+	}
+	return string(passphrase), err
+}
@@ -0,0 +1,11 @@
+package remote
+
+import (
+	"sync/atomic"
+)
+
+func (this *progressReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	atomic.AddInt64(this.count, int64(n))
+	return
+}
@@ -0,0 +1,22 @@
+package remote
+
+import (
+	"time"
+)
+
+// Blocks until n more bytes may pass.  A nil limiter never blocks.
+func (this *rateLimiter) wait(n int) {
+	if this == nil || n <= 0 {
+		return
+	}
+	this.mutex.Lock()
+	now := time.Now()
+	// No credit is given for time spent idle, so there are no bursts
+	if this.next.Before(now) {
+		this.next = now
+	}
+	this.next = this.next.Add(time.Duration(int64(n) * int64(time.Second) / this.rate))
+	delay := this.next.Sub(now)
+	this.mutex.Unlock()
+	time.Sleep(delay)
+}
@@ -1,214 +1,692 @@
 package remote
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/opslabjpl/earthkit-cli/config"
+	"github.com/opslabjpl/earthkit-cli/envelope"
 	"github.com/opslabjpl/earthkit-cli/fileset"
-	"github.com/opslabjpl/earthkit-cli/s3utils"
-	"github.com/opslabjpl/goamz/s3"
-	"github.com/opslabjpl/gotx/tx"
-	txFile "github.com/opslabjpl/gotx/tx/file"
-	txS3 "github.com/opslabjpl/gotx/tx/s3"
+	"github.com/opslabjpl/earthkit-cli/storage"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Determine if the workspace already exists in S3 by listing
-// for object that matches the workspace prefix
+// Determine if the workspace already exists in remote storage by listing
+// the workspaces and looking for this one
 func (this *Remote) Exists() bool {
 	wsPrefix := this.WorkspacePrefix()
-	data, err := this.bucket.List(wsPrefix, "", "", 1)
+	prefixes, err := this.storage.ListChildren(this.layout.Root())
 
 	if err != nil {
 		panic(err.Error())
 	}
 
-	return len(data.Contents) > 0
+	for _, prefix := range prefixes {
+		if prefix == wsPrefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Remote) Name() string {
+	return this.name
+}
+
+func (this *Remote) Layout() Layout {
+	return this.layout
 }
 
 func (this *Remote) WorkspacePrefix() string {
-	return fmt.Sprintf(WorkspacePrefix, this.name)
+	return this.layout.Workspace(this.name)
 }
 
 func (this *Remote) FilesPrefix() string {
-	return fmt.Sprintf(WorkspaceFilesPrefix, this.name)
+	return this.layout.Files(this.name)
 }
 
 func (this *Remote) FilesetsPrefix() string {
-	return fmt.Sprintf(WorkspaceFilesetsPrefix, this.name)
+	return this.layout.Filesets(this.name)
 }
 
-func (this *Remote) Filesets() ([]s3.Key, error) {
-	prefix := this.FilesetsPrefix()
-	keys := make([]s3.Key, 0, 64)
-	results, errs := this.bucket.ListAllAsync(prefix)
-	for key := range results {
-		keys = append(keys, key)
-	}
-	err := <-errs
-	return keys, err
+func (this *Remote) Filesets() ([]storage.Object, error) {
+	return this.storage.List(this.FilesetsPrefix())
+}
+
+func (this *Remote) Files() ([]storage.Object, error) {
+	return this.storage.List(this.FilesPrefix())
 }
 
 func (this *Remote) LatestFileset() (filesetName string, err error) {
-	s3Keys, err := this.Filesets()
+	objects, err := this.Filesets()
 	if err != nil {
 		return
 	}
 
-	timestamp := ""
+	var timestamp time.Time
 
-	for _, key := range s3Keys {
-		if timestamp < key.LastModified {
-			filesetName = strings.Replace(path.Base(key.Key), ".json.gz", "", 1)
-			timestamp = key.LastModified
+	for _, object := range objects {
+		if timestamp.Before(object.LastModified) {
+			filesetName = strings.Replace(path.Base(object.Key), ".json.gz", "", 1)
+			timestamp = object.LastModified
 		}
 	}
 	return
 }
 
-func (this *Remote) Upload(files map[string]string) {
-	txMgr := tx.NewTxMgr(32, false, false)
-	cTxDone := txMgr.NewTxChan(16)
-
-	prefix := this.FilesPrefix()
+// Uploads whole files, given as a map of file paths to their digests
+func (this *Remote) Upload(files map[string]string) error {
+	blobs := make([]Blob, 0, len(files))
 	for fileName, digest := range files {
-		key := path.Join(prefix, digest)
+		blobs = append(blobs, Blob{Path: fileName, Offset: 0, Size: -1, Digest: digest})
+	}
+	return this.UploadBlobs(blobs)
+}
+
+// Uploads every blob that does not already exist in remote storage.  With
+// the shared store, a blob another workspace has already pushed there is not
+// uploaded again, only referenced.  Locks taken here are released before
+// returning, so callers holding their own should release those before
+// exiting on an error.
+func (this *Remote) UploadBlobs(blobs []Blob) error {
+	transfers := make([]transfer, 0, len(blobs))
+	knownSize := int64(0)
+
+	shared := this.usesStore()
+	var storeRefs map[string]bool
+	if shared {
+		// Keeps gc of the store from running until the blobs are referenced
+		release, err := this.lockStore("push")
+		if err != nil {
+			return err
+		}
+		defer release()
+		if storeRefs, err = this.storeRefs(); err != nil {
+			return err
+		}
+	}
+
+	// Work out which blobs are already there from an inventory of the files
+	// prefix if one is cached, or if there are enough blobs that listing the
+	// prefix is cheaper than asking about each blob
+	inv := this.cachedInventory(shared)
+	if inv == nil && len(blobs) >= inventoryMinBlobs {
+		var err error
+		if inv, err = this.takeInventory(shared); err != nil {
+			return err
+		}
+	}
+
+	for _, blob := range blobs {
+		key := this.layout.File(this.name, blob.Digest)
+		if shared {
+			key = this.layout.StoreFile(blob.Digest)
+			if !storeRefs[blob.Digest] {
+				if err := this.storage.Put(this.layout.StoreRef(this.name, blob.Digest), []byte{}); err != nil {
+					return err
+				}
+				storeRefs[blob.Digest] = true
+			}
+		}
 
 		// No need to upload if the object is already there
-		if s3utils.S3ObjectExist(this.bucket, key) {
+		var exists bool
+		if inv != nil {
+			exists = inv.digests[blob.Digest]
+		} else {
+			var err error
+			if exists, err = this.storage.Exists(key); err != nil {
+				return err
+			}
+		}
+		if exists {
 			println("Skipping", key)
+			this.abortUpload(key)
 			continue
 		}
 
-		f, err := os.Open(fileName)
-		if err != nil {
-			log.Fatalf("error: %s", err)
-		}
-		src, err := txFile.NewSource(f, 5*1024*1024)
-		if err != nil {
-			log.Fatalf("error: %s", err)
+		size := blob.Size
+		if size < 0 {
+			info, err := os.Stat(blob.Path)
+			if err != nil {
+				return err
+			}
+			size = info.Size()
 		}
-		dst := txS3.NewDestination(this.bucket, key)
-		txMgr.Add(src, dst)
+		knownSize += size
+		transfers = append(transfers, transfer{blob.Path, key, blob.Offset, size})
 	}
 
 	// 'quit' channel used to coordinate progress goroutine and main goroutine.
 	quit := make(chan bool)
 	// Start a goroutine for outputting progress
-	go progressPrinter(txMgr.KnownSize(), txMgr.Wx, quit)
-
-	txMgr.Start()
+	var wx int64
+	go progressPrinter(knownSize, func() int64 { return atomic.LoadInt64(&wx) }, quit)
 
 	// Wait for all transfers to finish, aborting if there is even one error.
-	var err error = nil
-	for t := range cTxDone {
-		if err != nil {
-			continue
-		}
-		if t.Error() != nil {
-			err = t.Error()
-			log.Printf("Aborting upload due to error (this could take a few seconds).\n\terror: %s", err)
-			txMgr.Abort()
-		}
-	}
+	err := runTransfers(transfers, func(t transfer) error {
+		return this.upload(t, &wx)
+	})
 	quit <- true
 	<-quit
 	if err != nil {
-		log.Fatalf("Upload failed.")
+		log.Printf("Aborted upload due to error.\n\terror: %s", err)
+		if this.journal != nil {
+			return fmt.Errorf("Upload failed. Run the command again to resume it.")
+		}
+		return fmt.Errorf("Upload failed.")
 	}
 	fmt.Println("Progress: Completed")
+
+	if inv != nil && this.inventoryPath != "" {
+		for _, t := range transfers {
+			inv.digests[path.Base(t.key)] = true
+		}
+		if err := inv.save(this.inventoryPath); err != nil {
+			log.Printf("Unable to save inventory: %s", err)
+		}
+	}
+	return nil
+}
+
+// Makes uploads and downloads resumable, recording their progress in journal
+func (this *Remote) SetJournal(journal *Journal) {
+	this.journal = journal
+}
+
+// Caches the inventory of existing blobs taken by large uploads in a file
+// named after path and the storage location, where later uploads use it for
+// up to ttl.  An inventory of other storage at the same prefix is never used.
+func (this *Remote) SetInventoryCache(path string, ttl time.Duration) {
+	sum := sha1.Sum([]byte(this.storage.Location()))
+	ext := filepath.Ext(path)
+	this.inventoryPath = strings.TrimSuffix(path, ext) + "-" + hex.EncodeToString(sum[:4]) + ext
+	this.inventoryTTL = ttl
+}
+
+// Whether blobs are pushed to the shared content store.  Encrypted
+// workspaces never use it, since nobody else could read their blobs.
+func (this *Remote) usesStore() bool {
+	return this.sharedStore && !this.Encrypted()
+}
+
+// Returns the prefix blobs are uploaded under, and the key of the gc marker
+// that is rewritten before any are deleted from it
+func (this *Remote) blobsPrefix(shared bool) (prefix, marker string) {
+	if shared {
+		return this.layout.StoreFiles(), this.layout.StoreGCMarker()
+	}
+	return this.FilesPrefix(), this.layout.GCMarker(this.name)
+}
+
+// Returns the key of the blob with the given digest, looking first where it
+// would be uploaded to and then in the other place it could be, or "" if
+// neither has it
+func (this *Remote) locate(digest string, shared bool) (string, error) {
+	keys := []string{this.layout.File(this.name, digest), this.layout.StoreFile(digest)}
+	if shared {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	for _, key := range keys {
+		exists, err := this.storage.Exists(key)
+		if err != nil || exists {
+			return key, err
+		}
+	}
+	return "", nil
+}
+
+// Returns the digests of the blobs in the shared store this workspace
+// references
+func (this *Remote) storeRefs() (map[string]bool, error) {
+	objects, err := this.storage.List(this.layout.StoreWorkspaceRefs(this.name))
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		refs[path.Base(object.Key)] = true
+	}
+	return refs, nil
+}
+
+// Returns the cached inventory if there is one that can still be trusted,
+// otherwise nil
+func (this *Remote) cachedInventory(shared bool) *inventory {
+	if this.inventoryPath == "" {
+		return nil
+	}
+	inv, err := loadInventory(this.inventoryPath)
+	if err != nil || time.Since(inv.Listed) > this.inventoryTTL {
+		return nil
+	}
+	prefix, markerKey := this.blobsPrefix(shared)
+	if inv.Prefix != prefix {
+		return nil
+	}
+	// Without a marker, the prefix may have been deleted and recreated since
+	marker, err := this.gcMarker(markerKey)
+	if err != nil || marker == "" || marker != inv.GCMarker {
+		return nil
+	}
+	return inv
+}
+
+// Lists the prefix blobs are uploaded under.  The gc marker is read first,
+// so that deletions racing with the listing invalidate the result, and
+// written first if missing, so that deleting the prefix does too.
+func (this *Remote) takeInventory(shared bool) (*inventory, error) {
+	prefix, markerKey := this.blobsPrefix(shared)
+	marker, err := this.gcMarker(markerKey)
+	if err == nil && marker == "" {
+		if err = this.touchGCMarker(markerKey); err == nil {
+			marker, err = this.gcMarker(markerKey)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	objects, err := this.storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inventory{Listed: time.Now(), Prefix: prefix, GCMarker: marker, digests: make(map[string]bool, len(objects))}
+	for _, object := range objects {
+		inv.digests[path.Base(object.Key)] = true
+	}
+	return inv, nil
+}
+
+func (this *Remote) gcMarker(key string) (string, error) {
+	exists, err := this.storage.Exists(key)
+	if err != nil || !exists {
+		return "", err
+	}
+	data, err := this.storage.Get(key)
+	return string(data), err
+}
+
+// Must be called before deleting blobs, so that no inventory listing them
+// is used again
+func (this *Remote) touchGCMarker(key string) error {
+	return this.storage.Put(key, []byte(strconv.FormatInt(time.Now().UnixNano(), 36)))
+}
+
+func (this *Remote) upload(t transfer, wx *int64) error {
+	f, err := os.Open(t.localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Blobs are named after the digest of their uncompressed content, the
+	// compression used is only recorded in the metadata.  A resumed upload
+	// must produce the same bytes as before, so it reuses the metadata (and
+	// with it the data key) it started with.
+	var (
+		meta    storage.Metadata
+		dataKey []byte
+		state   storage.UploadState
+	)
+	if this.journal != nil {
+		entry := this.journal.upload(t.key)
+		if entry != nil && (entry.Meta[metaEncryption] != "") == (this.encryptionKey() != nil) {
+			if dataKey, err = this.dataKey(entry.Meta); err == nil {
+				meta, state = entry.Meta, entry.State
+			}
+		}
+		// One started with another key can't be resumed, so isn't kept either
+		if entry != nil && meta == nil {
+			this.abortUpload(t.key)
+		}
+	}
+	if meta == nil {
+		meta = make(storage.Metadata)
+		compression := compressionFor(t.localPath)
+		if compression != "" {
+			meta[metaCompression] = compression
+		}
+		if dataKey, err = this.newDataKey(meta); err != nil {
+			return err
+		}
+	}
+
+	var w storage.Writer
+	resumeAt := int64(0)
+	if this.journal == nil {
+		w, err = this.storage.NewWriter(t.key, meta)
+	} else {
+		w, resumeAt, err = this.storage.NewResumableWriter(t.key, meta, state, func(state storage.UploadState) {
+			if err := this.journal.putUpload(t.key, meta, state); err != nil {
+				log.Printf("Unable to update transfer journal: %s", err)
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// file -> compress -> encrypt -> (skip what's already stored) -> throttle
+	// -> storage
+	ew, err := encryptWriter(&skipWriter{&limitedWriter{w, this.uploadLimit}, resumeAt}, dataKey)
+	if err == nil {
+		var cw io.WriteCloser
+		cw, err = compressWriter(ew, meta[metaCompression])
+		if err == nil {
+			section := io.NewSectionReader(f, t.offset, t.size)
+			_, err = io.Copy(cw, &progressReader{section, wx})
+		}
+		if err == nil {
+			err = cw.Close()
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+	}
+	if err != nil {
+		// Leave journaled uploads to be resumed
+		if this.journal == nil {
+			w.Abort()
+		}
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if this.journal != nil {
+		return this.journal.removeUpload(t.key)
+	}
+	return nil
+}
+
+// Aborts the unfinished uploads recorded in the journal for blobs other than
+// the given ones, which a push that no longer needs them would otherwise
+// leave behind for good.  Call before pushing blobs, with all of them.
+func (this *Remote) AbortOtherUploads(blobs []Blob) {
+	if this.journal == nil {
+		return
+	}
+	shared := this.usesStore()
+	keep := make(map[string]bool)
+	for _, blob := range blobs {
+		if shared {
+			keep[this.layout.StoreFile(blob.Digest)] = true
+		} else {
+			keep[this.layout.File(this.name, blob.Digest)] = true
+		}
+	}
+	for _, key := range this.journal.uploadKeys() {
+		if !keep[key] {
+			this.abortUpload(key)
+		}
+	}
+}
+
+// Discards the journaled upload to key, if there is one, and forgets it.  An
+// upload that can't be aborted stays in the journal to be tried again.
+func (this *Remote) abortUpload(key string) {
+	if this.journal == nil {
+		return
+	}
+	entry := this.journal.upload(key)
+	if entry == nil {
+		return
+	}
+	if err := this.storage.AbortUpload(key, entry.State); err != nil {
+		log.Printf("Unable to abort unfinished upload of %s: %s", key, err)
+		return
+	}
+	if err := this.journal.removeUpload(key); err != nil {
+		log.Printf("Unable to update transfer journal: %s", err)
+	}
 }
 
+// Downloads the blobs with the given digests into files named after them in
+// localPath.  Blobs that were downloaded in full are kept if another one
+// fails, and journaled ones resume from where they stopped.
 func (this *Remote) Download(localPath string, digests []string) {
-	txMgr := tx.NewTxMgr(32, false, false)
-	cTxDone := txMgr.NewTxChan(16)
+	transfers := make([]transfer, 0, len(digests))
+	objects := make(map[string]storage.Object)
+	knownSize := int64(0)
 
-	prefix := this.FilesPrefix()
+	shared := this.usesStore()
 	for _, digest := range digests {
-		key := path.Join(prefix, digest)
-		fileName := path.Join(localPath, digest)
-		// Add as many files as you want here
-		src, err := txS3.NewSource(this.bucket, key, 5*1024*1024)
-		if err != nil {
-			log.Fatalf("error: %s", err)
+		key, err := this.locate(digest, shared)
+		if err == nil && key == "" {
+			err = fmt.Errorf("%s does not exist", this.layout.File(this.name, digest))
 		}
-		f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 666)
 		if err != nil {
 			log.Fatalf("error: %s", err)
 		}
-		dst, err := txFile.NewDestination(f)
+		fileName := path.Join(localPath, digest)
+		object, err := this.storage.Stat(key)
 		if err != nil {
 			log.Fatalf("error: %s", err)
 		}
-		txMgr.Add(src, dst)
+		objects[key] = object
+		knownSize += object.Size
+		transfers = append(transfers, transfer{fileName, key, 0, object.Size})
 	}
 
 	// 'quit' channel used to coordinate progress goroutine and main goroutine.
 	quit := make(chan bool)
 	// Start a goroutine for outputting progress
-	go progressPrinter(txMgr.KnownSize(), txMgr.Rx, quit)
-
-	txMgr.Start()
+	var rx int64
+	go progressPrinter(knownSize, func() int64 { return atomic.LoadInt64(&rx) }, quit)
 
 	// Wait for all transfers to finish, aborting if there is even one error.
-	var err error = nil
-	for t := range cTxDone {
-		if err != nil {
-			continue
-		}
-		if t.Error() != nil {
-			err = t.Error()
-			log.Printf("Aborting download due to error (this could take a few seconds).\n\terror: %s", err)
-			txMgr.Abort()
-		}
-	}
+	err := runTransfers(transfers, func(t transfer) error {
+		return this.download(t, objects[t.key], &rx)
+	})
 	quit <- true
 	<-quit
 	if err != nil {
-		// If the download was aborted, try to remove all the digests we were attempting to download.
-		for _, digest := range digests {
-			fileName := path.Join(localPath, digest)
-			os.Remove(fileName)
+		log.Printf("Aborted download due to error.\n\terror: %s", err)
+		if this.journal != nil {
+			log.Fatalf("Download failed. Run the command again to resume it.")
 		}
 		log.Fatalf("Download failed.")
 	}
 	fmt.Println("Progress: Completed")
 }
 
+// Downloads the blob with the given digest into the file localPath.  Unlike
+// Download it returns errors rather than exiting, for long running callers.
+func (this *Remote) DownloadFile(localPath string, digest string) error {
+	key, err := this.locate(digest, this.usesStore())
+	if err == nil && key == "" {
+		err = fmt.Errorf("%s does not exist", this.layout.File(this.name, digest))
+	}
+	if err != nil {
+		return err
+	}
+	object, err := this.storage.Stat(key)
+	if err != nil {
+		return err
+	}
+	var rx int64
+	return this.download(transfer{localPath, key, 0, object.Size}, object, &rx)
+}
+
+// The stored (encrypted and compressed) object is first fetched into a
+// partial file, which a later run can continue with a range request, and
+// only decoded once complete.
+func (this *Remote) download(t transfer, object storage.Object, rx *int64) error {
+	partial := t.localPath + partialSuffix
+	offset := int64(0)
+	if this.journal != nil {
+		entry := this.journal.download(t.key)
+		if entry != nil && entry.Size == object.Size && entry.LastModified.Equal(object.LastModified) {
+			if info, err := os.Stat(partial); err == nil && info.Size() <= object.Size {
+				offset = info.Size()
+			}
+		}
+		if err := this.journal.putDownload(t.key, object); err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flags, 0600)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(rx, offset)
+	if offset < object.Size {
+		var r io.ReadCloser
+		r, _, err = this.storage.NewRangeReader(t.key, offset)
+		if err == nil {
+			_, err = io.Copy(f, &progressReader{&limitedReader{r, this.downloadLimit}, rx})
+			r.Close()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	// A partial file that doesn't decode can't be resumed either
+	err = this.decode(partial, t.localPath, object.Meta)
+	os.Remove(partial)
+	if this.journal != nil {
+		if jerr := this.journal.removeDownload(t.key); err == nil {
+			err = jerr
+		}
+	}
+	return err
+}
+
+// Decrypts and decompresses the downloaded object src into dst, which only
+// appears once complete
+func (this *Remote) decode(src string, dst string, meta storage.Metadata) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// storage -> decrypt -> decompress -> file
+	plain, err := this.decryptReader(in, meta)
+	if err != nil {
+		return err
+	}
+	dr, err := decompressReader(plain, meta[metaCompression])
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tmp := dst + partialSuffix + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, dr)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Whether the blob with the given digest is in remote storage
+func (this *Remote) FileExists(digest string) (bool, error) {
+	key, err := this.locate(digest, this.usesStore())
+	return key != "", err
+}
+
+// Reads the blob with the given digest back through decryption and
+// decompression and checks that its content hashes to the digest.  found is
+// false if there is no such blob; err describes why a found blob is bad.
+func (this *Remote) VerifyFile(digest string) (found bool, err error) {
+	key, err := this.locate(digest, this.usesStore())
+	if err != nil || key == "" {
+		return
+	}
+	found = true
+	r, meta, err := this.storage.NewReader(key)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	plain, err := this.decryptReader(r, meta)
+	if err != nil {
+		return
+	}
+	dr, err := decompressReader(plain, meta[metaCompression])
+	if err != nil {
+		return
+	}
+	defer dr.Close()
+	actual, err := fileset.Hexdigest(dr)
+	if err == nil && actual != digest {
+		err = fmt.Errorf("content hashes to %s", actual)
+	}
+	return
+}
+
 func (this *Remote) PutFileset(name string, data []byte) error {
-	key := path.Join(this.FilesetsPrefix(), name)
-	return this.bucket.Put(key, data, "application/json", s3.Private, s3.Options{})
+	key := this.FilesetsPrefix() + name
+	return this.putObject(key, data)
 }
 
 func (this *Remote) PutDiscoveryURL(data []byte) error {
-	key := path.Join(this.WorkspacePrefix(), "discovery_url")
-	return this.bucket.Put(key, data, "", s3.Private, s3.Options{})
+	key := this.layout.DiscoveryURL(this.name)
+	return this.storage.Put(key, data)
 }
 
 func (this *Remote) GetDiscoveryURL() []byte {
-	key := path.Join(this.WorkspacePrefix(), "discovery_url")
-	discoveryUrl, err := this.bucket.Get(key)
+	key := this.layout.DiscoveryURL(this.name)
+	discoveryUrl, err := this.storage.Get(key)
 	if err != nil {
 		log.Fatal("Unable to fetch discovery url")
 	}
 	return discoveryUrl
 }
 
-func (this *Remote) GetFileset(filesetName string) *fileset.FileSet {
-	prefix := this.FilesetsPrefix()
-	filesetGzFile := filesetName + ".json.gz"
-	path := prefix + filesetGzFile
+func (this *Remote) FilesetExists(filesetName string) (bool, error) {
+	return this.storage.Exists(this.layout.Fileset(this.name, filesetName))
+}
 
-	exists, _ := this.bucket.Exists(path)
+// Returns the raw (gzipped json) contents of a fileset
+func (this *Remote) GetFilesetData(filesetName string) ([]byte, error) {
+	key := this.layout.Fileset(this.name, filesetName)
+
+	exists, err := this.FilesetExists(filesetName)
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
-		log.Fatal("Fileset " + filesetName + " does not exist.")
+		return nil, fmt.Errorf("Fileset %s does not exist.", filesetName)
 	}
+	return this.getObject(key)
+}
 
-	data, err := this.bucket.Get(path)
+func (this *Remote) GetFileset(filesetName string) *fileset.FileSet {
+	data, err := this.GetFilesetData(filesetName)
 	if err != nil {
-		log.Fatal("Unable to fetch fileset")
+		log.Fatal(err)
 	}
 	remoteFileSet, err := fileset.LoadGzJson(data)
 	if err != nil {
@@ -217,6 +695,1059 @@ func (this *Remote) GetFileset(filesetName string) *fileset.FileSet {
 	return remoteFileSet
 }
 
+// Writes a fileset's manifest and summary under the publish lock.  check, if
+// not nil, is called once the lock is held and can refuse to publish, for
+// instance when the name is taken: since every push publishes under the
+// lock, it sees every fileset published before and none is published until
+// this one has been written.
+func (this *Remote) PublishFileset(filesetName string, fileSet *fileset.FileSet, data []byte, check func() error) error {
+	release, err := this.Lock("publish")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if check != nil {
+		if err = check(); err != nil {
+			return err
+		}
+	}
+	if err = this.PutFileset(filesetName+".json.gz", data); err != nil {
+		return err
+	}
+	return this.PutFilesetSummary(filesetName, fileSet)
+}
+
+// Stores the summary of a fileset listed by FilesetSummaries.  Written after
+// the manifest at push time.
+func (this *Remote) PutFilesetSummary(filesetName string, fileSet *fileset.FileSet) error {
+	data, err := json.Marshal(summarize(filesetName, fileSet))
+	if err != nil {
+		return err
+	}
+	return this.putObject(this.layout.Summary(this.name, filesetName), data)
+}
+
+// Returns the summaries of every fileset, sorted by name.  Filesets pushed
+// before summaries were stored, or whose summary is unreadable, have their
+// manifest fetched instead; StoreMissingSummaries saves that next time.
+func (this *Remote) FilesetSummaries() ([]FilesetSummary, error) {
+	lookups, err := this.summaryLookups()
+	if err != nil {
+		return nil, err
+	}
+
+	// Up to as many lookups at once as transfers, each worker filling in
+	// the summaries and errors at the indexes it is given
+	summaries := make([]FilesetSummary, len(lookups))
+	errs := make([]error, len(lookups))
+	workers := *config.TRANSFERS
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				summaries[i], errs[i] = this.filesetSummary(lookups[i])
+			}
+		}()
+	}
+	for i := range lookups {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+// Stores a summary for every fileset that lacks one, one at a time, returning
+// how many were stored
+func (this *Remote) StoreMissingSummaries() (stored int, err error) {
+	lookups, err := this.summaryLookups()
+	if err != nil {
+		return
+	}
+	for _, lookup := range lookups {
+		if lookup.stored {
+			continue
+		}
+		var fileSet *fileset.FileSet
+		if fileSet, err = this.loadFileset(lookup.name); err != nil {
+			return
+		}
+		if err = this.PutFilesetSummary(lookup.name, fileSet); err != nil {
+			return
+		}
+		stored++
+	}
+	return
+}
+
+// Lists the filesets, noting which have a stored summary
+func (this *Remote) summaryLookups() ([]summaryLookup, error) {
+	filesets, err := this.Filesets()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := this.storage.List(this.layout.Summaries(this.name))
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+	}
+	lookups := make([]summaryLookup, 0, len(filesets))
+	for _, object := range filesets {
+		name := fileset.FileSetNameFromFile(object.Key)
+		lookups = append(lookups, summaryLookup{name, stored[this.layout.Summary(this.name, name)]})
+	}
+	return lookups, nil
+}
+
+// Reads a fileset's stored summary, or builds one from its manifest if there
+// is none or it is unreadable
+func (this *Remote) filesetSummary(lookup summaryLookup) (FilesetSummary, error) {
+	if lookup.stored {
+		var summary FilesetSummary
+		data, err := this.getObject(this.layout.Summary(this.name, lookup.name))
+		if err == nil && json.Unmarshal(data, &summary) == nil && summary.Name == lookup.name {
+			return summary, nil
+		}
+	}
+	fileSet, err := this.loadFileset(lookup.name)
+	if err != nil {
+		return FilesetSummary{}, err
+	}
+	return *summarize(lookup.name, fileSet), nil
+}
+
+// Fetches and parses a fileset's manifest, returning errors rather than
+// exiting like GetFileset
+func (this *Remote) loadFileset(filesetName string) (*fileset.FileSet, error) {
+	data, err := this.GetFilesetData(filesetName)
+	if err != nil {
+		return nil, err
+	}
+	fileSet, err := fileset.LoadGzJson(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse fileset %s: %s", filesetName, err)
+	}
+	return fileSet, nil
+}
+
+// Deletes only the fileset's manifest and summary, not the files it
+// references
+func (this *Remote) DeleteFileset(filesetName string) error {
+	if err := this.storage.Delete(this.layout.Fileset(this.name, filesetName)); err != nil {
+		return err
+	}
+	return this.storage.Delete(this.layout.Summary(this.name, filesetName))
+}
+
+// Deletes the blob with the given digest from wherever it is stored.  Holds
+// the gc lock there while doing so, since a push may have found the blob and
+// be about to publish a fileset relying on it.
+func (this *Remote) DeleteFile(digest string) error {
+	release, err := this.Lock("gc")
+	if err != nil {
+		return err
+	}
+	defer release()
+	key, err := this.locate(digest, this.usesStore())
+	if err != nil || key == "" {
+		return err
+	}
+	shared := strings.HasPrefix(key, this.layout.StoreFiles())
+	if shared {
+		releaseStore, err := this.lockStore("gc")
+		if err != nil {
+			return err
+		}
+		defer releaseStore()
+	}
+	_, marker := this.blobsPrefix(shared)
+	if err = this.touchGCMarker(marker); err != nil {
+		return err
+	}
+	return this.storage.Delete(key)
+}
+
+// Returns the key of the blob with the given digest, or if there is none, the
+// key it would be uploaded to
+func (this *Remote) BlobKey(digest string) (string, error) {
+	shared := this.usesStore()
+	key, err := this.locate(digest, shared)
+	if err != nil || key != "" {
+		return key, err
+	}
+	if shared {
+		return this.layout.StoreFile(digest), nil
+	}
+	return this.layout.File(this.name, digest), nil
+}
+
+// Returns every ref of this workspace mapped to the fileset it points at
+func (this *Remote) Refs() (map[string]string, error) {
+	refs := make(map[string]string)
+	objects, err := this.storage.List(this.layout.Refs(this.name))
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		target, err := this.storage.Get(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		refs[path.Base(object.Key)] = strings.TrimSpace(string(target))
+	}
+	return refs, nil
+}
+
+// Returns the name of the fileset the ref points at, or an empty string if
+// there is no such ref
+func (this *Remote) GetRef(ref string) (string, error) {
+	key := this.layout.Ref(this.name, ref)
+	exists, err := this.storage.Exists(key)
+	if err != nil || !exists {
+		return "", err
+	}
+	target, err := this.storage.Get(key)
+	return strings.TrimSpace(string(target)), err
+}
+
+// Points the ref at the given fileset, creating the ref if needed
+func (this *Remote) PutRef(ref string, filesetName string) error {
+	if ref == "" || strings.ContainsAny(ref, "/\\") {
+		return fmt.Errorf("Invalid ref name: %q", ref)
+	}
+	exists, err := this.FilesetExists(filesetName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Fileset %s does not exist.", filesetName)
+	}
+	return this.storage.Put(this.layout.Ref(this.name, ref), []byte(filesetName))
+}
+
+func (this *Remote) DeleteRef(ref string) error {
+	return this.storage.Delete(this.layout.Ref(this.name, ref))
+}
+
+// Turns a fileset name or a ref into a fileset name.  Filesets take
+// precedence over refs of the same name.  Names that are neither are
+// returned unchanged so that the caller reports the missing fileset.
+func (this *Remote) ResolveFileset(name string) (string, error) {
+	exists, err := this.storage.Exists(this.layout.Fileset(this.name, name))
+	if err != nil || exists {
+		return name, err
+	}
+	target, err := this.GetRef(name)
+	if err != nil {
+		return name, err
+	}
+	if target == "" {
+		return name, nil
+	}
+	return target, nil
+}
+
+// Whether the workspace's data is encrypted
+func (this *Remote) Encrypted() bool {
+	doc, err := this.encryptionDoc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return doc != nil
+}
+
+// Returns the id of the key the workspace is currently encrypted with
+func (this *Remote) KeyID() string {
+	doc, err := this.encryptionDoc()
+	if err != nil || doc == nil {
+		return ""
+	}
+	return doc.KeyID
+}
+
+// Starts encrypting everything pushed to this workspace with a key read from
+// (or generated into) keyFile, or derived from a passphrase if keyFile is
+// empty.  Data pushed before remains readable but is not encrypted.
+func (this *Remote) EnableEncryption(keyFile string) error {
+	if this.Encrypted() {
+		return fmt.Errorf("Workspace %s is already encrypted", this.name)
+	}
+	key, doc, err := newKey(keyFile, passphraseEnv)
+	if err != nil {
+		return err
+	}
+	if err = this.putEncryptionDoc(this.layout.Encryption(this.name), doc); err != nil {
+		return err
+	}
+	this.keyMutex.Lock()
+	this.key, this.keyLoaded = key, true
+	this.keyMutex.Unlock()
+	return nil
+}
+
+// Re-wraps the data key of every encrypted object with a new key.  The data
+// itself is not re-encrypted.  The new key is recorded as pending before any
+// object is touched, and only replaces the old one once every object has
+// been re-wrapped, so an interrupted rotation can be run again with the same
+// new key (or passphrase) and carries on where it stopped.  The gc lock keeps
+// pushes from writing objects wrapped with the old key meanwhile.
+func (this *Remote) RotateKey(newKeyFile string) error {
+	release, err := this.Lock("gc")
+	if err != nil {
+		return err
+	}
+	defer release()
+	oldKey := this.encryptionKey()
+	if oldKey == nil {
+		return fmt.Errorf("Workspace %s is not encrypted", this.name)
+	}
+
+	var key *envelope.Key
+	pendingKey := this.layout.PendingEncryption(this.name)
+	doc, err := this.getEncryptionDoc(pendingKey)
+	if err != nil {
+		return err
+	}
+	if doc != nil {
+		fmt.Printf("Resuming the rotation to key %s\n", doc.KeyID)
+		if key, err = keyFor(doc, newKeyFile, newPassphraseEnv, "New passphrase: "); err != nil {
+			return fmt.Errorf("An interrupted rotation must be finished with the same new key: %s", err)
+		}
+	} else {
+		if key, doc, err = newKey(newKeyFile, newPassphraseEnv); err != nil {
+			return err
+		}
+		if err = this.putEncryptionDoc(pendingKey, doc); err != nil {
+			return err
+		}
+	}
+
+	objects, err := this.storage.List(this.WorkspacePrefix())
+	if err != nil {
+		return err
+	}
+	rotated := 0
+	for _, object := range objects {
+		object, err = this.storage.Stat(object.Key)
+		if err != nil {
+			return err
+		}
+		if object.Meta[metaEncryption] == "" || object.Meta[metaKeyID] != oldKey.ID {
+			continue
+		}
+		dataKey, err := oldKey.Unwrap(object.Meta[metaDataKey])
+		if err != nil {
+			return fmt.Errorf("%s: %s", object.Key, err)
+		}
+		wrapped, err := key.Wrap(dataKey)
+		if err != nil {
+			return err
+		}
+		object.Meta[metaDataKey] = wrapped
+		object.Meta[metaKeyID] = key.ID
+		if err = this.storage.SetMeta(object.Key, object.Meta); err != nil {
+			return fmt.Errorf("%s: %s", object.Key, err)
+		}
+		rotated++
+	}
+	fmt.Printf("Re-wrapped the keys of %d objects\n", rotated)
+
+	if err = this.putEncryptionDoc(this.layout.Encryption(this.name), doc); err != nil {
+		return err
+	}
+	this.keyMutex.Lock()
+	this.key = key
+	this.keyMutex.Unlock()
+	return this.storage.Delete(pendingKey)
+}
+
+func (this *Remote) encryptionDoc() (*encryptionDoc, error) {
+	return this.getEncryptionDoc(this.layout.Encryption(this.name))
+}
+
+// Reads the encryption doc stored at key, or returns nil if there is none
+func (this *Remote) getEncryptionDoc(key string) (*encryptionDoc, error) {
+	exists, err := this.storage.Exists(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := this.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	doc := new(encryptionDoc)
+	err = json.Unmarshal(data, doc)
+	return doc, err
+}
+
+func (this *Remote) putEncryptionDoc(key string, doc *encryptionDoc) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return this.storage.Put(key, data)
+}
+
+// Returns the workspace's key encryption key, obtaining it the first time it
+// is needed.  Returns nil if the workspace is not encrypted.
+func (this *Remote) encryptionKey() *envelope.Key {
+	this.keyMutex.Lock()
+	defer this.keyMutex.Unlock()
+	if !this.keyLoaded {
+		doc, err := this.encryptionDoc()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if doc != nil {
+			this.key, err = loadKey(doc)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		this.keyLoaded = true
+	}
+	return this.key
+}
+
+// Creates a data key for a new object and records it, wrapped, in meta.
+// Returns nil if the workspace is not encrypted.
+func (this *Remote) newDataKey(meta storage.Metadata) ([]byte, error) {
+	key := this.encryptionKey()
+	if key == nil {
+		return nil, nil
+	}
+	dataKey, err := envelope.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := key.Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	meta[metaEncryption] = "aes-256-gcm"
+	meta[metaDataKey] = wrapped
+	meta[metaKeyID] = key.ID
+	return dataKey, nil
+}
+
+// Wraps r to decrypt an object with the given metadata.  Objects that were
+// not encrypted are returned as is.
+func (this *Remote) decryptReader(r io.Reader, meta storage.Metadata) (io.Reader, error) {
+	dataKey, err := this.dataKey(meta)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return r, nil
+	}
+	return envelope.NewReader(r, dataKey)
+}
+
+// Unwraps the data key of an object with the given metadata; nil if the
+// object is not encrypted
+func (this *Remote) dataKey(meta storage.Metadata) ([]byte, error) {
+	if meta[metaEncryption] == "" {
+		return nil, nil
+	}
+	key := this.encryptionKey()
+	if key == nil {
+		return nil, fmt.Errorf("Object is encrypted but workspace %s has no encryption key", this.name)
+	}
+	if meta[metaKeyID] != key.ID {
+		return nil, fmt.Errorf("Object is encrypted with key %s, but the workspace key is %s", meta[metaKeyID], key.ID)
+	}
+	return key.Unwrap(meta[metaDataKey])
+}
+
+// Stores a small object (such as a fileset manifest), encrypting it if the
+// workspace is encrypted
+func (this *Remote) putObject(key string, data []byte) error {
+	meta := make(storage.Metadata)
+	dataKey, err := this.newDataKey(meta)
+	if err != nil {
+		return err
+	}
+	if dataKey != nil {
+		if data, err = envelope.Seal(data, dataKey); err != nil {
+			return err
+		}
+	}
+	w, err := this.storage.NewWriter(key, meta)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Reads an object stored with putObject
+func (this *Remote) getObject(key string) ([]byte, error) {
+	r, meta, err := this.storage.NewReader(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	plain, err := this.decryptReader(r, meta)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plain)
+}
+
+// Takes a lock on the workspace, returning a function that releases it.
+// "gc" locks exclude all others, "publish" locks exclude each other, and any
+// number of "push" locks may be held at once.  Publish locks are only held
+// briefly, so taking one waits for another push to release its own.
+func (this *Remote) Lock(kind string) (release func(), err error) {
+	for attempt := 1; ; attempt++ {
+		release, err = lock(this.storage, this.layout.Locks(this.name), "Workspace "+this.name, kind)
+		if _, conflict := err.(*lockConflict); !conflict || kind != "publish" || attempt == publishAttempts {
+			return
+		}
+		// Two pushes backing off in step would keep seeing each other
+		time.Sleep(publishRetryWait/2 + time.Duration(rand.Int63n(int64(publishRetryWait))))
+	}
+}
+
+// Takes a lock on the shared content store, like Lock
+func (this *Remote) lockStore(kind string) (release func(), err error) {
+	return lock(this.storage, this.layout.StoreLocks(), "The shared content store", kind)
+}
+
+// Deletes blobs that no fileset references.  Blobs modified within the grace
+// period are kept even if unreferenced, since a push may be about to write a
+// fileset referencing them.  With dryRun nothing is deleted, but the report
+// shows what would be.
+func (this *Remote) GC(grace time.Duration, dryRun bool) (report GCReport, err error) {
+	if !dryRun {
+		var release func()
+		release, err = this.Lock("gc")
+		if err != nil {
+			return
+		}
+		defer release()
+		if err = this.touchGCMarker(this.layout.GCMarker(this.name)); err != nil {
+			return
+		}
+	}
+
+	// List blobs before reading the filesets: a blob uploaded after this
+	// listing can't be deleted by this run
+	blobs, err := this.Files()
+	if err != nil {
+		return
+	}
+	report.Blobs = len(blobs)
+
+	// Mark
+	reachable := make(map[string]bool)
+	filesets, err := this.Filesets()
+	if err != nil {
+		return
+	}
+	existing := make(map[string]bool)
+	for _, object := range filesets {
+		name := fileset.FileSetNameFromFile(object.Key)
+		existing[name] = true
+		data, err := this.GetFilesetData(name)
+		if err != nil {
+			return report, err
+		}
+		// Never sweep on the basis of a manifest we can't read
+		fileSet, err := fileset.LoadGzJson(data)
+		if err != nil {
+			return report, fmt.Errorf("Unable to parse fileset %s: %s", name, err)
+		}
+		for digest, _ := range fileSet.Root.BlobDigests() {
+			reachable[digest] = true
+		}
+	}
+	report.Filesets = len(filesets)
+	refs, err := this.Refs()
+	if err != nil {
+		return
+	}
+	for ref, target := range refs {
+		if !existing[target] {
+			report.DanglingRefs = append(report.DanglingRefs, ref)
+		}
+	}
+
+	// Sweep
+	for _, blob := range blobs {
+		digest := path.Base(blob.Key)
+		if reachable[digest] {
+			report.Referenced++
+			continue
+		}
+		report.Unreferenced++
+		if time.Since(blob.LastModified) < grace {
+			report.TooRecent++
+			continue
+		}
+		report.Reclaimable += blob.Size
+		if dryRun {
+			continue
+		}
+		if err = this.storage.Delete(blob.Key); err != nil {
+			return
+		}
+		report.Deleted++
+		report.DeletedBytes += blob.Size
+	}
+	err = this.gcStore(reachable, grace, dryRun, &report)
+	return
+}
+
+// Drops this workspace's references to blobs in the shared store that none
+// of its filesets need, then deletes the store's blobs that no workspace
+// references.  References and blobs within the grace period are kept.
+func (this *Remote) gcStore(reachable map[string]bool, grace time.Duration, dryRun bool, report *GCReport) error {
+	// Workspaces that have never used the store leave it alone
+	if !this.sharedStore {
+		refs, err := this.storeRefs()
+		if err != nil || len(refs) == 0 {
+			return err
+		}
+	}
+	if !dryRun {
+		release, err := this.lockStore("gc")
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err = this.touchGCMarker(this.layout.StoreGCMarker()); err != nil {
+			return err
+		}
+	}
+
+	refs, err := this.storage.List(this.layout.StoreRefs())
+	if err != nil {
+		return err
+	}
+	ownRefs := this.layout.StoreWorkspaceRefs(this.name)
+	referenced := make(map[string]bool)
+	for _, ref := range refs {
+		digest := path.Base(ref.Key)
+		if strings.HasPrefix(ref.Key, ownRefs) && !reachable[digest] && time.Since(ref.LastModified) >= grace {
+			report.StoreRefsDropped++
+			if !dryRun {
+				if err = this.storage.Delete(ref.Key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		referenced[digest] = true
+	}
+
+	blobs, err := this.storage.List(this.layout.StoreFiles())
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if referenced[path.Base(blob.Key)] || time.Since(blob.LastModified) < grace {
+			continue
+		}
+		report.StoreReclaimable += blob.Size
+		if dryRun {
+			continue
+		}
+		if err = this.storage.Delete(blob.Key); err != nil {
+			return err
+		}
+		report.StoreDeleted++
+		report.StoreDeletedBytes += blob.Size
+	}
+	return nil
+}
+
+// Returns the workspace's metadata, or nil if it has none
+func (this *Remote) Info() (*WorkspaceInfo, error) {
+	key := this.layout.Info(this.name)
+	exists, err := this.storage.Exists(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := this.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	info := new(WorkspaceInfo)
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (this *Remote) PutInfo(info *WorkspaceInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return this.storage.Put(this.layout.Info(this.name), data)
+}
+
+// Deletes every object belonging to the workspace: refs and filesets first,
+// then its references into the shared store and its own files, then
+// everything else.  Holds the gc lock, so it fails
+// rather than pull the rug from under a push.
+func (this *Remote) Delete() error {
+	release, err := this.Lock("gc")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return this.delete()
+}
+
+// Does the work of Delete, which the caller must hold the gc lock for
+func (this *Remote) delete() error {
+	if err := this.touchGCMarker(this.layout.GCMarker(this.name)); err != nil {
+		return err
+	}
+
+	// Blobs in the shared store are left for gc once unreferenced
+	prefixes := []string{this.layout.Refs(this.name), this.FilesetsPrefix(), this.layout.Summaries(this.name), this.layout.StoreWorkspaceRefs(this.name), this.FilesPrefix(), this.WorkspacePrefix()}
+	for _, prefix := range prefixes {
+		objects, err := this.storage.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			// Our own lock goes last, when it's released
+			if strings.HasPrefix(object.Key, this.layout.Locks(this.name)) && time.Since(object.LastModified) < StaleLockAge {
+				continue
+			}
+			if err = this.storage.Delete(object.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copies every fileset, and only the files they reference, to dst, which may
+// be in another bucket, region or account.  Refs, metadata and the encryption
+// key (wrapped as it is here) are copied too.  Files dst already has are
+// skipped, so an interrupted copy can simply be run again.  Every referenced
+// file is then read back from dst and its digest checked, and the copy fails
+// if any is missing or corrupt; only then is it safe to delete this workspace,
+// which MoveTo does.
+func (this *Remote) CopyTo(dst *Remote) (report CopyReport, err error) {
+	// A push lock holds off gc without blocking pushes
+	release, err := this.Lock("push")
+	if err != nil {
+		return
+	}
+	defer release()
+	return this.copyTo(dst)
+}
+
+// Copies the workspace to dst like CopyTo, then deletes it.  The gc lock is
+// held throughout, so that no fileset can be pushed after the filesets to
+// copy are listed and then lost with the rest of the workspace.
+func (this *Remote) MoveTo(dst *Remote) (report CopyReport, err error) {
+	release, err := this.Lock("gc")
+	if err != nil {
+		return
+	}
+	defer release()
+	if report, err = this.copyTo(dst); err != nil {
+		return
+	}
+	err = this.delete()
+	return
+}
+
+// Does the work of CopyTo, with the caller holding a lock on this workspace
+func (this *Remote) copyTo(dst *Remote) (report CopyReport, err error) {
+	if dst.Exists() && dst.KeyID() != this.KeyID() {
+		return report, fmt.Errorf("Workspace %s already exists at the destination with a different encryption key", dst.name)
+	}
+	release, err := dst.Lock("push")
+	if err != nil {
+		return
+	}
+	defer release()
+	copyKey := func(key string) error {
+		return storage.Copy(this.storage, key, dst.storage, dst.WorkspacePrefix()+strings.TrimPrefix(key, this.WorkspacePrefix()))
+	}
+
+	// The key goes first, since nothing at dst can be read without it
+	if this.Encrypted() {
+		if err = copyKey(this.layout.Encryption(this.name)); err != nil {
+			return
+		}
+	}
+
+	filesets, err := this.Filesets()
+	if err != nil {
+		return
+	}
+	referenced := make(map[string]int64)
+	for _, object := range filesets {
+		name := fileset.FileSetNameFromFile(object.Key)
+		data, err := this.GetFilesetData(name)
+		if err != nil {
+			return report, err
+		}
+		fileSet, err := fileset.LoadGzJson(data)
+		if err != nil {
+			return report, fmt.Errorf("Unable to parse fileset %s: %s", name, err)
+		}
+		for digest, size := range fileSet.Root.BlobDigests() {
+			referenced[digest] = size
+		}
+	}
+	report.Filesets = len(filesets)
+	report.Files = len(referenced)
+
+	// Files before the filesets referencing them, as a push would
+	existing, err := dst.Files()
+	if err != nil {
+		return
+	}
+	present := make(map[string]bool)
+	for _, object := range existing {
+		present[path.Base(object.Key)] = true
+	}
+	transfers := make([]transfer, 0, len(referenced))
+	for digest, size := range referenced {
+		if present[digest] {
+			report.Skipped++
+			continue
+		}
+		transfers = append(transfers, transfer{key: digest, size: size})
+		report.Bytes += size
+	}
+	fmt.Printf("Copying %d of %d files (%d bytes) to %s\n", len(transfers), len(referenced), report.Bytes, dst.WorkspacePrefix())
+	shared := this.usesStore()
+	err = runTransfers(transfers, func(t transfer) error {
+		// Files in the shared store are copied into the workspace itself
+		key, err := this.locate(t.key, shared)
+		if err == nil && key == "" {
+			err = fmt.Errorf("missing")
+		}
+		if err == nil {
+			err = storage.Copy(this.storage, key, dst.storage, dst.layout.File(dst.name, t.key))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	report.Copied = len(transfers)
+
+	fmt.Printf("Verifying %d files\n", len(referenced))
+	verifications := make([]transfer, 0, len(referenced))
+	for digest, _ := range referenced {
+		verifications = append(verifications, transfer{key: digest})
+	}
+	err = runTransfers(verifications, func(t transfer) error {
+		found, err := dst.VerifyFile(t.key)
+		if err == nil && !found {
+			err = fmt.Errorf("missing")
+		}
+		if err != nil {
+			return fmt.Errorf("Verification of %s failed: %s", t.key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, object := range filesets {
+		if err = copyKey(object.Key); err != nil {
+			return
+		}
+	}
+	summaries, err := this.storage.List(this.layout.Summaries(this.name))
+	if err != nil {
+		return
+	}
+	refs, err := this.storage.List(this.layout.Refs(this.name))
+	if err != nil {
+		return
+	}
+	for _, object := range append(summaries, refs...) {
+		if err = copyKey(object.Key); err != nil {
+			return
+		}
+	}
+	for _, key := range []string{this.layout.Info(this.name), this.layout.DiscoveryURL(this.name)} {
+		exists, err := this.storage.Exists(key)
+		if err != nil {
+			return report, err
+		}
+		if exists {
+			if err = copyKey(key); err != nil {
+				return report, err
+			}
+		}
+	}
+	return
+}
+
+// Moves every object of this workspace to the same place under another
+// layout.  Nothing is deleted from the old location until everything has been
+// copied, so an interrupted migration can simply be run again: objects
+// already at the new location with the same size are not copied again, and
+// any that differ mean another workspace is in the way.  Blobs it references
+// in the shared store are copied to the new layout's store, and dropped from
+// the old one once no other workspace references them.  The gc lock is held
+// throughout, so a migration won't start during a push and no push can write
+// objects that would be left behind.
+func (this *Remote) Migrate(dst Layout) (*Remote, error) {
+	if dst.Root() == this.layout.Root() {
+		return this, nil
+	}
+	newRemote := New(this.name, this.storage, dst)
+	release, err := this.Lock("gc")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Locks aren't moved: ours goes when it's released, and others are stale
+	srcPrefix := this.WorkspacePrefix()
+	listed, err := this.storage.List(srcPrefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]storage.Object, 0, len(listed))
+	var staleLocks []storage.Object
+	for _, object := range listed {
+		if !strings.HasPrefix(object.Key, this.layout.Locks(this.name)) {
+			objects = append(objects, object)
+		} else if time.Since(object.LastModified) >= StaleLockAge {
+			staleLocks = append(staleLocks, object)
+		}
+	}
+	existing, err := this.storage.List(newRemote.WorkspacePrefix())
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(existing))
+	for _, object := range existing {
+		sizes[object.Key] = object.Size
+	}
+	fmt.Printf("Moving %d objects from %s to %s\n", len(objects), srcPrefix, newRemote.WorkspacePrefix())
+	for _, object := range objects {
+		dstKey := newRemote.WorkspacePrefix() + strings.TrimPrefix(object.Key, srcPrefix)
+		if size, ok := sizes[dstKey]; ok {
+			if size != object.Size {
+				return nil, fmt.Errorf("Workspace %s already exists under %s and differs at %s", this.name, dst.Root(), dstKey)
+			}
+			continue
+		}
+		if err = this.copyObject(object.Key, dstKey); err != nil {
+			return nil, err
+		}
+	}
+	refs, err := this.storeRefs()
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) > 0 {
+		if err = this.migrateStoreBlobs(newRemote, refs); err != nil {
+			return nil, err
+		}
+	}
+	for _, object := range append(objects, staleLocks...) {
+		if err = this.storage.Delete(object.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Our references into the old store go, along with any of its blobs no
+	// other workspace still references
+	if len(refs) > 0 {
+		var report GCReport
+		if err = this.gcStore(map[string]bool{}, 0, false, &report); err != nil {
+			log.Printf("Unable to clean up the shared store under %s: %s", this.layout.Root(), err)
+			for digest := range refs {
+				if err = this.storage.Delete(this.layout.StoreRef(this.name, digest)); err != nil {
+					return nil, err
+				}
+			}
+		} else if report.StoreDeleted > 0 {
+			fmt.Printf("Deleted %d files (%d bytes) no longer referenced from the shared store under %s\n", report.StoreDeleted, report.StoreDeletedBytes, this.layout.Root())
+		}
+	}
+	return newRemote, nil
+}
+
+// Copies the blobs of the shared store the workspace references into the
+// store of dst's layout, referencing each before it is copied as a push
+// would.  Blobs already there are skipped.
+func (this *Remote) migrateStoreBlobs(dst *Remote, refs map[string]bool) error {
+	release, err := dst.lockStore("push")
+	if err != nil {
+		return err
+	}
+	defer release()
+	stored, err := this.storage.List(this.layout.StoreFiles())
+	if err != nil {
+		return err
+	}
+	existing, err := this.storage.List(dst.layout.StoreFiles())
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, object := range existing {
+		present[path.Base(object.Key)] = true
+	}
+	copied := 0
+	for _, object := range stored {
+		digest := path.Base(object.Key)
+		if !refs[digest] {
+			continue
+		}
+		if err = this.storage.Put(dst.layout.StoreRef(dst.name, digest), []byte{}); err != nil {
+			return err
+		}
+		if present[digest] {
+			continue
+		}
+		if err = this.copyObject(object.Key, dst.layout.StoreFile(digest)); err != nil {
+			return err
+		}
+		copied++
+	}
+	fmt.Printf("Copied %d files from the shared store under %s to the one under %s\n", copied, this.layout.Root(), dst.layout.Root())
+	return nil
+}
+
+func (this *Remote) copyObject(srcKey, dstKey string) error {
+	return storage.Copy(this.storage, srcKey, this.storage, dstKey)
+}
+
 // A function for printing the progress of a transfer while it's happening. This is intented to be
 // launched as a goroutine.  'quitChan' should be an unbuffered channel used for coordinating the
 // shutdown of the goroutine.  'quitChan' should be sent a value when the goroutine should stop.
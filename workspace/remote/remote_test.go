@@ -0,0 +1,869 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/opslabjpl/earthkit-cli/config"
+	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a remote workspace backed by a temporary directory, along with a
+// local file to push to it
+func tempRemote(t *testing.T) (*Remote, string, func()) {
+	dir, err := ioutil.TempDir("", "earthkit-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localDir := filepath.Join(dir, "local")
+	os.Mkdir(localDir, 0700)
+	remoteWs := New("ws", storage.NewLocal(filepath.Join(dir, "remote")), NewLayout(".earthkit"))
+	return remoteWs, localDir, func() { os.RemoveAll(dir) }
+}
+
+func pushAndPull(t *testing.T, remoteWs *Remote, localDir string, data []byte) []byte {
+	fileName := filepath.Join(localDir, "data.txt")
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	remoteWs.Upload(map[string]string{fileName: digest})
+
+	cacheDir := filepath.Join(localDir, "cache")
+	os.Mkdir(cacheDir, 0700)
+	remoteWs.Download(cacheDir, []string{digest})
+	pulled, err := ioutil.ReadFile(filepath.Join(cacheDir, digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pulled
+}
+
+func TestRemote_CompressedEncryptedRoundTrip(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	*config.COMPRESSION = "gzip"
+	defer func() { *config.COMPRESSION = "none" }()
+	if err := remoteWs.EnableEncryption(filepath.Join(localDir, "key")); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("earthkit "), 100000)
+	if pulled := pushAndPull(t, remoteWs, localDir, data); !bytes.Equal(pulled, data) {
+		t.Fatal("pulled data differs from pushed data")
+	}
+
+	// The stored blob is neither plaintext nor uncompressed
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	stored, _ := remoteWs.storage.Get(remoteWs.layout.File("ws", digest))
+	if len(stored) >= len(data) || bytes.Contains(stored, []byte("earthkit")) {
+		t.Fatal("blob was not compressed and encrypted")
+	}
+
+	// Manifests are encrypted too
+	remoteWs.PutFileset("fs.json.gz", []byte("manifest"))
+	manifest, err := remoteWs.GetFilesetData("fs")
+	if err != nil || string(manifest) != "manifest" {
+		t.Fatalf("GetFilesetData returned %q, %v", manifest, err)
+	}
+}
+
+func TestRemote_RotateKey(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	oldKeyFile := filepath.Join(localDir, "old.key")
+	if err := remoteWs.EnableEncryption(oldKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	remoteWs.PutFileset("fs.json.gz", []byte("manifest"))
+	oldID := remoteWs.KeyID()
+
+	if err := remoteWs.RotateKey(filepath.Join(localDir, "new.key")); err != nil {
+		t.Fatal(err)
+	}
+	if remoteWs.KeyID() == oldID {
+		t.Fatal("key id did not change")
+	}
+	manifest, err := remoteWs.GetFilesetData("fs")
+	if err != nil || string(manifest) != "manifest" {
+		t.Fatalf("GetFilesetData after rotation returned %q, %v", manifest, err)
+	}
+}
+
+// Fails SetMeta after a number of calls, to interrupt a key rotation
+type failingStorage struct {
+	storage.Storage
+	setMetaCalls int
+}
+
+func (this *failingStorage) SetMeta(key string, meta storage.Metadata) error {
+	if this.setMetaCalls == 0 {
+		return fmt.Errorf("interrupted")
+	}
+	this.setMetaCalls--
+	return this.Storage.SetMeta(key, meta)
+}
+
+func TestRemote_RotateKeyResumes(t *testing.T) {
+	remoteWs, _, cleanup := tempRemote(t)
+	defer cleanup()
+	os.Setenv(passphraseEnv, "old passphrase")
+	os.Setenv(newPassphraseEnv, "new passphrase")
+	defer os.Unsetenv(passphraseEnv)
+	defer os.Unsetenv(newPassphraseEnv)
+
+	if err := remoteWs.EnableEncryption(""); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		remoteWs.PutFileset(name+".json.gz", []byte("manifest "+name))
+	}
+	oldID := remoteWs.KeyID()
+
+	// Only the first object is re-wrapped before the rotation stops
+	store := remoteWs.storage
+	remoteWs.storage = &failingStorage{store, 1}
+	if err := remoteWs.RotateKey(""); err == nil {
+		t.Fatal("interrupted rotation succeeded")
+	}
+	remoteWs.storage = store
+	if remoteWs.KeyID() != oldID {
+		t.Fatal("interrupted rotation switched keys")
+	}
+
+	// Running it again derives the same key from the pending salt
+	if err := remoteWs.RotateKey(""); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := store.Exists(remoteWs.layout.PendingEncryption("ws")); exists {
+		t.Fatal("pending rotation was kept")
+	}
+	os.Setenv(passphraseEnv, "new passphrase")
+	fresh := New("ws", store, remoteWs.layout)
+	for _, name := range names {
+		if data, err := fresh.GetFilesetData(name); err != nil || string(data) != "manifest "+name {
+			t.Fatalf("fileset %s after resumed rotation is %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestRemote_GC(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	files := make(map[string]string)
+	var digests []string
+	for _, name := range []string{"kept", "garbage"} {
+		fileName := filepath.Join(localDir, name)
+		ioutil.WriteFile(fileName, []byte(name), 0644)
+		digest, _ := fileset.Hexdigest(bytes.NewReader([]byte(name)))
+		files[fileName] = digest
+		digests = append(digests, digest)
+	}
+	remoteWs.Upload(files)
+
+	fileSet := fileset.FileSet{Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{
+		"kept": &fileset.Entry{Mode: 0644, Size: 4, Digest: digests[0]},
+	}}}
+	data, _ := fileSet.GzJson()
+	remoteWs.PutFileset("fs.json.gz", data)
+
+	// Everything is within the grace period
+	report, err := remoteWs.GC(time.Hour, false)
+	if err != nil || report.Deleted != 0 || report.TooRecent != 1 {
+		t.Fatalf("GC within grace period returned %+v, %v", report, err)
+	}
+
+	report, err = remoteWs.GC(0, true)
+	if err != nil || report.Deleted != 0 || report.Reclaimable == 0 {
+		t.Fatalf("dry run returned %+v, %v", report, err)
+	}
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.File("ws", digests[1])); !ok {
+		t.Fatal("dry run deleted a blob")
+	}
+
+	// A push in progress holds off gc
+	release, err := remoteWs.Lock("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = remoteWs.GC(0, false); err == nil {
+		t.Fatal("GC ran while a push held the lock")
+	}
+	release()
+
+	report, err = remoteWs.GC(0, false)
+	if err != nil || report.Deleted != 1 || report.Referenced != 1 {
+		t.Fatalf("GC returned %+v, %v", report, err)
+	}
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.File("ws", digests[0])); !ok {
+		t.Fatal("GC deleted a referenced blob")
+	}
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.File("ws", digests[1])); ok {
+		t.Fatal("GC kept an unreferenced blob")
+	}
+}
+
+func TestRemote_VerifyFile(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	data := []byte("earthkit")
+	pushAndPull(t, remoteWs, localDir, data)
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	if found, err := remoteWs.VerifyFile(digest); !found || err != nil {
+		t.Fatalf("VerifyFile of a good blob returned %v, %v", found, err)
+	}
+
+	remoteWs.storage.Put(remoteWs.layout.File("ws", digest), []byte("corrupted"))
+	if found, err := remoteWs.VerifyFile(digest); !found || err == nil {
+		t.Fatalf("VerifyFile of a corrupt blob returned %v, %v", found, err)
+	}
+	if found, _ := remoteWs.VerifyFile("missing"); found {
+		t.Fatal("VerifyFile found a missing blob")
+	}
+}
+
+// Interrupted transfers are resumed rather than restarted, which the tests
+// detect by planting a partial transfer whose start differs from the data
+func TestRemote_ResumeUpload(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	journal, err := OpenJournal(filepath.Join(localDir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteWs.SetJournal(journal)
+
+	data := []byte("0123456789")
+	fileName := filepath.Join(localDir, "data")
+	ioutil.WriteFile(fileName, data, 0644)
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	key := remoteWs.layout.File("ws", digest)
+
+	meta := make(storage.Metadata)
+	w, _, err := remoteWs.storage.NewResumableWriter(key, meta, storage.UploadState{}, func(state storage.UploadState) {
+		journal.putUpload(key, meta, state)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("abcde"))
+
+	remoteWs.Upload(map[string]string{fileName: digest})
+	stored, _ := remoteWs.storage.Get(key)
+	if string(stored) != "abcde56789" {
+		t.Fatalf("upload was not resumed: stored %q", stored)
+	}
+	if len(journal.Uploads) != 0 {
+		t.Fatal("finished upload left in the journal")
+	}
+}
+
+// Unfinished uploads the journal no longer needs are aborted rather than
+// forgotten, so nothing is left behind in storage
+func TestRemote_AbortUnneededUploads(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	journal, err := OpenJournal(filepath.Join(localDir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteWs.SetJournal(journal)
+
+	// One blob turns out to exist by the time it is pushed again, the other
+	// has been dropped from the push
+	var blobs []Blob
+	var partials []string
+	for _, content := range []string{"existing", "dropped"} {
+		data := []byte(content)
+		fileName := filepath.Join(localDir, content)
+		ioutil.WriteFile(fileName, data, 0644)
+		digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+		key := remoteWs.layout.File("ws", digest)
+		meta := make(storage.Metadata)
+		w, _, err := remoteWs.storage.NewResumableWriter(key, meta, storage.UploadState{}, func(state storage.UploadState) {
+			journal.putUpload(key, meta, state)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("abc"))
+		partials = append(partials, filepath.Join(filepath.Dir(localDir), "remote", filepath.FromSlash(key)+".resumable"+partialSuffix))
+		if content == "existing" {
+			remoteWs.storage.Put(key, data)
+			blobs = append(blobs, Blob{Path: fileName, Offset: 0, Size: -1, Digest: digest})
+		}
+	}
+
+	remoteWs.AbortOtherUploads(blobs)
+	if err = remoteWs.UploadBlobs(blobs); err != nil {
+		t.Fatal(err)
+	}
+	for _, partial := range partials {
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Fatalf("unfinished upload %s was left behind", partial)
+		}
+	}
+	if len(journal.Uploads) != 0 {
+		t.Fatalf("aborted uploads left in the journal: %v", journal.Uploads)
+	}
+}
+
+func TestRemote_ResumeDownload(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	journal, err := OpenJournal(filepath.Join(localDir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteWs.SetJournal(journal)
+
+	data := []byte("0123456789")
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	key := remoteWs.layout.File("ws", digest)
+	remoteWs.storage.Put(key, data)
+	object, _ := remoteWs.storage.Stat(key)
+	journal.putDownload(key, object)
+	ioutil.WriteFile(filepath.Join(localDir, digest+partialSuffix), []byte("abcde"), 0600)
+
+	remoteWs.Download(localDir, []string{digest})
+	pulled, _ := ioutil.ReadFile(filepath.Join(localDir, digest))
+	if string(pulled) != "abcde56789" {
+		t.Fatalf("download was not resumed: got %q", pulled)
+	}
+	if _, err := os.Stat(filepath.Join(localDir, digest+partialSuffix)); !os.IsNotExist(err) {
+		t.Fatal("partial download left behind")
+	}
+}
+
+func TestRateLimiter_SharedAcrossGoroutines(t *testing.T) {
+	limiter := newRateLimiter(1 << 20)
+	start := time.Now()
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 4; j++ {
+				limiter.wait(32 << 10)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	// 512 KiB at 1 MiB/s
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Fatalf("transferred 512 KiB in %s", elapsed)
+	}
+}
+
+func TestRemote_InventoryInvalidatedByDeletes(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	remoteWs.SetInventoryCache(filepath.Join(localDir, "inventory.json"), time.Hour)
+
+	data := []byte("earthkit")
+	pushAndPull(t, remoteWs, localDir, data)
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+
+	inv, err := remoteWs.takeInventory(false)
+	if err != nil || !inv.digests[digest] {
+		t.Fatalf("inventory %v is missing the pushed blob (%v)", inv, err)
+	}
+	inv.save(remoteWs.inventoryPath)
+	if remoteWs.cachedInventory(false) == nil {
+		t.Fatal("fresh inventory was not used")
+	}
+
+	remoteWs.DeleteFile(digest)
+	if remoteWs.cachedInventory(false) != nil {
+		t.Fatal("inventory was used after a blob was deleted")
+	}
+}
+
+// A workspace deleted and created again loses its gc marker, which must not
+// leave an inventory of the old one looking current
+func TestRemote_InventoryNeedsGCMarker(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	inventoryPath := filepath.Join(localDir, "inventory.json")
+	remoteWs.SetInventoryCache(inventoryPath, time.Hour)
+
+	pushAndPull(t, remoteWs, localDir, []byte("earthkit"))
+	inv, err := remoteWs.takeInventory(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.save(remoteWs.inventoryPath)
+	if inv.GCMarker == "" || remoteWs.cachedInventory(false) == nil {
+		t.Fatalf("inventory was taken without a gc marker: %+v", inv)
+	}
+
+	remoteWs.storage.Delete(remoteWs.layout.GCMarker("ws"))
+	if remoteWs.cachedInventory(false) != nil {
+		t.Fatal("inventory was used without a gc marker")
+	}
+
+	// Nor is it used for other storage
+	other := New("ws", storage.NewLocal(filepath.Join(localDir, "other")), NewLayout(".earthkit"))
+	other.SetInventoryCache(inventoryPath, time.Hour)
+	if other.inventoryPath == remoteWs.inventoryPath {
+		t.Fatalf("inventories of different storage are both cached in %s", other.inventoryPath)
+	}
+}
+
+func TestRemote_DeleteFileInStore(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	remoteWs.sharedStore = true
+
+	data := []byte("stored")
+	pushAndPull(t, remoteWs, localDir, data)
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	if key, err := remoteWs.BlobKey(digest); err != nil || key != remoteWs.layout.StoreFile(digest) {
+		t.Fatalf("BlobKey returned %q, %v", key, err)
+	}
+
+	// Not while a push that may have found the blob is in progress
+	release, err := remoteWs.lockStore("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remoteWs.DeleteFile(digest); err == nil {
+		t.Fatal("blob deleted during a push")
+	}
+	release()
+	if err = remoteWs.DeleteFile(digest); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := remoteWs.VerifyFile(digest); found {
+		t.Fatal("blob was not deleted")
+	}
+}
+
+func TestRemote_Delete(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	remoteWs.PutInfo(&WorkspaceInfo{Description: "test", Created: time.Now()})
+	pushAndPull(t, remoteWs, localDir, []byte("earthkit"))
+	remoteWs.PutFileset("fs.json.gz", []byte("manifest"))
+	remoteWs.PutRef("stable", "fs")
+	if info, err := remoteWs.Info(); err != nil || info.Description != "test" {
+		t.Fatalf("Info returned %v, %v", info, err)
+	}
+
+	if err := remoteWs.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if remoteWs.Exists() {
+		objects, _ := remoteWs.storage.List(remoteWs.WorkspacePrefix())
+		t.Fatalf("workspace still exists: %v", objects)
+	}
+}
+
+func TestRemote_CopyTo(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	files := make(map[string]string)
+	var digests []string
+	for _, name := range []string{"kept", "garbage"} {
+		fileName := filepath.Join(localDir, name)
+		ioutil.WriteFile(fileName, []byte(name), 0644)
+		digest, _ := fileset.Hexdigest(bytes.NewReader([]byte(name)))
+		files[fileName] = digest
+		digests = append(digests, digest)
+	}
+	remoteWs.Upload(files)
+	fileSet := fileset.FileSet{Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{
+		"kept": &fileset.Entry{Mode: 0644, Size: 4, Digest: digests[0]},
+	}}}
+	data, _ := fileSet.GzJson()
+	remoteWs.PutFileset("fs.json.gz", data)
+	remoteWs.PutRef("stable", "fs")
+
+	dst := New("ws", storage.NewLocal(filepath.Join(localDir, "dst")), NewLayout("other"))
+	report, err := remoteWs.CopyTo(dst)
+	if err != nil || report.Filesets != 1 || report.Copied != 1 {
+		t.Fatalf("CopyTo returned %+v, %v", report, err)
+	}
+	if found, err := dst.VerifyFile(digests[0]); !found || err != nil {
+		t.Fatalf("referenced file not copied: %v, %v", found, err)
+	}
+	if found, _ := dst.VerifyFile(digests[1]); found {
+		t.Fatal("unreferenced file copied")
+	}
+	if target, err := dst.GetRef("stable"); err != nil || target != "fs" {
+		t.Fatalf("ref copied as %q, %v", target, err)
+	}
+
+	// Running it again copies nothing
+	report, err = remoteWs.CopyTo(dst)
+	if err != nil || report.Copied != 0 || report.Skipped != 1 {
+		t.Fatalf("second CopyTo returned %+v, %v", report, err)
+	}
+}
+
+func TestRemote_MoveTo(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	pushAndPull(t, remoteWs, localDir, []byte("moved"))
+	fileSet := fileset.FileSet{Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{}}}
+	data, _ := fileSet.GzJson()
+	remoteWs.PutFileset("fs.json.gz", data)
+	dst := New("ws", storage.NewLocal(filepath.Join(localDir, "dst")), NewLayout("other"))
+
+	// A push in progress could publish a fileset the move would then delete
+	release, err := remoteWs.Lock("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = remoteWs.MoveTo(dst); err == nil {
+		t.Fatal("move went ahead during a push")
+	}
+	if !remoteWs.Exists() {
+		t.Fatal("refused move deleted the workspace")
+	}
+	release()
+
+	report, err := remoteWs.MoveTo(dst)
+	if err != nil || report.Filesets != 1 {
+		t.Fatalf("MoveTo returned %+v, %v", report, err)
+	}
+	if exists, _ := dst.FilesetExists("fs"); !exists {
+		t.Fatal("fileset was not moved")
+	}
+	if filesets, _ := remoteWs.Filesets(); len(filesets) != 0 {
+		t.Fatalf("filesets left behind: %v", filesets)
+	}
+}
+
+func TestRemote_SharedStore(t *testing.T) {
+	*config.SHARED_STORE = true
+	defer func() { *config.SHARED_STORE = false }()
+	dir, err := ioutil.TempDir("", "earthkit-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := storage.NewLocal(filepath.Join(dir, "remote"))
+	layout := NewLayout(".earthkit")
+
+	data := []byte("shared")
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	fileName := filepath.Join(dir, "data")
+	ioutil.WriteFile(fileName, data, 0644)
+	fileSet := fileset.FileSet{Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{
+		"data": &fileset.Entry{Mode: 0644, Size: int64(len(data)), Digest: digest},
+	}}}
+	manifest, _ := fileSet.GzJson()
+
+	var workspaces []*Remote
+	for _, name := range []string{"a", "b"} {
+		remoteWs := New(name, store, layout)
+		remoteWs.Upload(map[string]string{fileName: digest})
+		remoteWs.PutFileset("fs.json.gz", manifest)
+		workspaces = append(workspaces, remoteWs)
+	}
+	if objects, _ := store.List(layout.StoreFiles()); len(objects) != 1 {
+		t.Fatalf("store holds %d blobs", len(objects))
+	}
+	if objects, _ := workspaces[0].Files(); len(objects) != 0 {
+		t.Fatal("blob stored in the workspace as well as the store")
+	}
+	if names, _ := Workspaces(store, layout); len(names) != 2 {
+		t.Fatalf("Workspaces returned %v", names)
+	}
+
+	// Once one workspace no longer needs the blob, the other still holds it
+	workspaces[0].DeleteFileset("fs")
+	report, err := workspaces[0].GC(0, false)
+	if err != nil || report.StoreRefsDropped != 1 || report.StoreDeleted != 0 {
+		t.Fatalf("GC returned %+v, %v", report, err)
+	}
+	if found, err := workspaces[1].VerifyFile(digest); !found || err != nil {
+		t.Fatalf("shared blob lost: %v, %v", found, err)
+	}
+
+	if err = workspaces[1].Delete(); err != nil {
+		t.Fatal(err)
+	}
+	report, err = workspaces[0].GC(0, false)
+	if err != nil || report.StoreDeleted != 1 {
+		t.Fatalf("GC after the last reference went returned %+v, %v", report, err)
+	}
+}
+
+func TestRemote_FilesetSummaries(t *testing.T) {
+	remoteWs, _, cleanup := tempRemote(t)
+	defer cleanup()
+
+	crTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"new", "old"} {
+		fileSet := fileset.FileSet{Size: 10, Count: 2, CrTime: crTime, Comment: name + " comment",
+			Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{}}}
+		data, _ := fileSet.GzJson()
+		remoteWs.PutFileset(name+".json.gz", data)
+		// Filesets pushed before summaries existed have none
+		if name == "new" {
+			if err := remoteWs.PutFilesetSummary(name, &fileSet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	summaries, err := remoteWs.FilesetSummaries()
+	if err != nil || len(summaries) != 2 {
+		t.Fatalf("FilesetSummaries returned %+v, %v", summaries, err)
+	}
+	for i, name := range []string{"new", "old"} {
+		summary := summaries[i]
+		if summary.Name != name || summary.Size != 10 || summary.Count != 2 || !summary.CrTime.Equal(crTime) || summary.Comment != name+" comment" {
+			t.Fatalf("summary %d is %+v", i, summary)
+		}
+	}
+	// Listing never writes; missing summaries are only stored when asked
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.Summary("ws", "old")); ok {
+		t.Fatal("listing wrote a summary")
+	}
+	if stored, err := remoteWs.StoreMissingSummaries(); stored != 1 || err != nil {
+		t.Fatalf("StoreMissingSummaries returned %d, %v", stored, err)
+	}
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.Summary("ws", "old")); !ok {
+		t.Fatal("missing summary was not stored")
+	}
+
+	if err = remoteWs.DeleteFileset("new"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := remoteWs.storage.Exists(remoteWs.layout.Summary("ws", "new")); ok {
+		t.Fatal("summary of deleted fileset was kept")
+	}
+}
+
+func TestRemote_MigrateResumes(t *testing.T) {
+	remoteWs, _, cleanup := tempRemote(t)
+	defer cleanup()
+
+	remoteWs.PutFileset("a.json.gz", []byte("manifest a"))
+	remoteWs.PutFileset("b.json.gz", []byte("manifest b"))
+	dst := NewLayout("moved")
+
+	// A migration that stopped after copying one object
+	remoteWs.copyObject(remoteWs.layout.Fileset("ws", "a"), dst.Fileset("ws", "a"))
+
+	// Nothing moves while a push is in progress
+	release, err := remoteWs.Lock("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = remoteWs.Migrate(dst); err == nil {
+		t.Fatal("migration went ahead during a push")
+	}
+	release()
+
+	newRemote, err := remoteWs.Migrate(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locks, _ := remoteWs.storage.List(dst.Locks("ws")); len(locks) != 0 {
+		t.Fatalf("locks were migrated: %v", locks)
+	}
+	for _, name := range []string{"a", "b"} {
+		if data, err := newRemote.GetFilesetData(name); err != nil || string(data) != "manifest "+name {
+			t.Fatalf("fileset %s after migration is %q, %v", name, data, err)
+		}
+	}
+	if remoteWs.Exists() {
+		t.Fatal("old location was not emptied")
+	}
+
+	// Another workspace of the same name is not overwritten
+	remoteWs.PutFileset("a.json.gz", []byte("another manifest"))
+	if _, err = remoteWs.Migrate(dst); err == nil {
+		t.Fatal("migration over a different workspace succeeded")
+	}
+}
+
+func TestRemote_MigrateSharedStore(t *testing.T) {
+	*config.SHARED_STORE = true
+	defer func() { *config.SHARED_STORE = false }()
+	dir, err := ioutil.TempDir("", "earthkit-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := storage.NewLocal(filepath.Join(dir, "remote"))
+	layout := NewLayout(".earthkit")
+	dst := NewLayout("moved")
+
+	data := []byte("shared")
+	digest, _ := fileset.Hexdigest(bytes.NewReader(data))
+	fileName := filepath.Join(dir, "data")
+	ioutil.WriteFile(fileName, data, 0644)
+	var workspaces []*Remote
+	for _, name := range []string{"a", "b"} {
+		remoteWs := New(name, store, layout)
+		remoteWs.Upload(map[string]string{fileName: digest})
+		workspaces = append(workspaces, remoteWs)
+	}
+
+	for i, remoteWs := range workspaces {
+		newRemote, err := remoteWs.Migrate(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found, err := newRemote.VerifyFile(digest); !found || err != nil {
+			t.Fatalf("blob of %s missing after migration: %v, %v", remoteWs.Name(), found, err)
+		}
+		if refs, _ := newRemote.storeRefs(); !refs[digest] {
+			t.Fatalf("reference of %s into the store was not migrated", remoteWs.Name())
+		}
+		// The old store keeps the blob only while the other workspace is
+		// still there
+		exists, _ := store.Exists(layout.StoreFile(digest))
+		if exists != (i == 0) {
+			t.Fatalf("after migrating %s, old store holds the blob: %v", remoteWs.Name(), exists)
+		}
+	}
+	if refs, _ := store.List(layout.StoreRefs()); len(refs) != 0 {
+		t.Fatalf("references left in the old store: %v", refs)
+	}
+}
+
+func TestRemote_ConcurrentKeyLoad(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+
+	keyFile := filepath.Join(localDir, "key")
+	if err := remoteWs.EnableEncryption(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	*config.ENCRYPTION_KEY_FILE = keyFile
+	defer func() { *config.ENCRYPTION_KEY_FILE = "" }()
+
+	// A fresh Remote loads the key on first use, from whichever transfer
+	// needs it first
+	fresh := New("ws", remoteWs.storage, remoteWs.layout)
+	files := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		data := []byte(strings.Repeat("x", i+1))
+		fileName := filepath.Join(localDir, strconv.Itoa(i))
+		ioutil.WriteFile(fileName, data, 0644)
+		files[fileName], _ = fileset.Hexdigest(bytes.NewReader(data))
+	}
+	fresh.Upload(files)
+
+	cacheDir := filepath.Join(localDir, "cache")
+	os.Mkdir(cacheDir, 0700)
+	digests := make([]string, 0, len(files))
+	for _, digest := range files {
+		digests = append(digests, digest)
+	}
+	New("ws", remoteWs.storage, remoteWs.layout).Download(cacheDir, digests)
+	for fileName, digest := range files {
+		want, _ := ioutil.ReadFile(fileName)
+		if got, err := ioutil.ReadFile(filepath.Join(cacheDir, digest)); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s pulled as %q, %v", fileName, got, err)
+		}
+	}
+}
+
+func TestRemote_LockRefresh(t *testing.T) {
+	remoteWs, _, cleanup := tempRemote(t)
+	defer cleanup()
+
+	defer func(interval time.Duration) { lockRefresh = interval }(lockRefresh)
+	lockRefresh = 10 * time.Millisecond
+
+	release, err := remoteWs.Lock("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, _ := remoteWs.storage.List(remoteWs.layout.Locks("ws"))
+	if len(locks) != 1 {
+		t.Fatalf("found locks %v", locks)
+	}
+	taken := locks[0].LastModified
+	time.Sleep(100 * time.Millisecond)
+	refreshed, _ := remoteWs.storage.Stat(locks[0].Key)
+	if !refreshed.LastModified.After(taken) {
+		t.Fatal("held lock was not refreshed")
+	}
+
+	release()
+	release()
+	time.Sleep(50 * time.Millisecond)
+	if locks, _ = remoteWs.storage.List(remoteWs.layout.Locks("ws")); len(locks) != 0 {
+		t.Fatalf("released lock came back: %v", locks)
+	}
+}
+
+func TestRemote_FailedUploadReleasesLocks(t *testing.T) {
+	remoteWs, localDir, cleanup := tempRemote(t)
+	defer cleanup()
+	remoteWs.sharedStore = true
+
+	err := remoteWs.UploadBlobs([]Blob{{Path: filepath.Join(localDir, "missing"), Size: -1, Digest: "0123"}})
+	if err == nil {
+		t.Fatal("upload of a missing file succeeded")
+	}
+	if locks, _ := remoteWs.storage.List(remoteWs.layout.StoreLocks()); len(locks) != 0 {
+		t.Fatalf("failed upload left locks behind: %v", locks)
+	}
+}
+
+func TestRemote_ConcurrentPublish(t *testing.T) {
+	remoteWs, _, cleanup := tempRemote(t)
+	defer cleanup()
+
+	// Each push checks that the name is free, as Push does, then waits for
+	// the others to have checked too before publishing; without the publish
+	// lock they would all see the name free and all overwrite it
+	const pushes = 4
+	checked := make(chan bool, pushes)
+	results := make(chan error, pushes)
+	for i := 0; i < pushes; i++ {
+		go func(i int) {
+			fileSet := fileset.FileSet{Comment: strconv.Itoa(i), Root: &fileset.Entry{Mode: os.ModeDir | 0755, Tree: fileset.EntryMap{}}}
+			data, _ := fileSet.GzJson()
+			results <- remoteWs.PublishFileset("fs", &fileSet, data, func() error {
+				exists, err := remoteWs.FilesetExists("fs")
+				if err != nil {
+					return err
+				}
+				checked <- true
+				if exists {
+					return fmt.Errorf("fs already exists")
+				}
+				time.Sleep(2 * publishRetryWait)
+				return nil
+			})
+		}(i)
+	}
+
+	published := 0
+	for i := 0; i < pushes; i++ {
+		err := <-results
+		if err == nil {
+			published++
+		} else if err.Error() != "fs already exists" {
+			t.Fatal(err)
+		}
+	}
+	if published != 1 || len(checked) != pushes {
+		t.Fatalf("%d of %d concurrent pushes published, %d checked", published, pushes, len(checked))
+	}
+}
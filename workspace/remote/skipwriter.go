@@ -0,0 +1,15 @@
+package remote
+
+func (this *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if this.skip >= int64(n) {
+		this.skip -= int64(n)
+		return n, nil
+	}
+	p = p[this.skip:]
+	this.skip = 0
+	if _, err := this.writer.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
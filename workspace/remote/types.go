@@ -1,10 +1,226 @@
 package remote
 
 import (
-	"github.com/opslabjpl/goamz/s3"
+	"github.com/opslabjpl/earthkit-cli/envelope"
+	"github.com/opslabjpl/earthkit-cli/storage"
+	"io"
+	"sync"
+	"time"
 )
 
 type Remote struct {
+	name    string
+	storage storage.Storage
+	layout  Layout
+	// Whether unencrypted blobs are pushed to the shared content store
+	sharedStore bool
+	// Key encryption key, loaded on first use; nil if not encrypted.
+	// Concurrent transfers share it, so it is guarded by keyMutex, which is
+	// held while it is loaded so that only one of them prompts.
+	key       *envelope.Key
+	keyLoaded bool
+	keyMutex  sync.Mutex
+	// Records unfinished transfers for resuming; nil if they aren't resumable
+	journal *Journal
+	// Shared by all concurrent transfers in each direction; nil if unlimited
+	uploadLimit   *rateLimiter
+	downloadLimit *rateLimiter
+	// Local file caching the inventory of existing blobs, if any, and how
+	// long it is trusted for
+	inventoryPath string
+	inventoryTTL  time.Duration
+}
+
+// Layout maps workspaces, filesets and file blobs to storage keys, all of
+// which live under a common key prefix (s3_key_prefix by default):
+//
+//	<prefix>/<workspace>/discovery_url
+//	<prefix>/<workspace>/gc_marker
+//	<prefix>/<workspace>/encryption.json
+//	<prefix>/<workspace>/workspace.json
+//	<prefix>/<workspace>/filesets/<fileset>.json.gz
+//	<prefix>/<workspace>/summaries/<fileset>.json
+//	<prefix>/<workspace>/files/<digest>
+//	<prefix>/<workspace>/refs/<ref>
+//	<prefix>/<workspace>/locks/<kind>-<host>-<pid>-<time>
+//
+// and the content store shared by workspaces when shared_store is set:
+//
+//	<prefix>/_store/gc_marker
+//	<prefix>/_store/files/<digest>
+//	<prefix>/_store/refs/<workspace>/<digest>
+//	<prefix>/_store/locks/<kind>-<host>-<pid>-<time>
+type Layout struct {
+	prefix string
+}
+
+// A fileset's details without its entries, stored beside the manifest
+type FilesetSummary struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Count   int64     `json:"count"`
+	CrTime  time.Time `json:"crtime"`
+	Comment string    `json:"comment,omitempty"`
+	Parent  string    `json:"parent,omitempty"`
+	Author  string    `json:"author,omitempty"`
+	Host    string    `json:"host,omitempty"`
+}
+
+// What Remote.CopyTo found and did
+type CopyReport struct {
+	Filesets int
+	// Files referenced by the filesets
+	Files int
+	// Files copied, and those the destination already had
+	Copied  int
+	Skipped int
+	// Uncompressed size of the files copied
+	Bytes int64
+}
+
+// Descriptive metadata about a workspace, recorded when it is created.
+// Workspaces created before this was introduced have none.
+type WorkspaceInfo struct {
+	Description string    `json:"description,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Created     time.Time `json:"created"`
+	// Fileset (or ref) cloned when no fileset is given
+	DefaultFileset string            `json:"default_fileset,omitempty"`
+	Settings       map[string]string `json:"settings,omitempty"`
+}
+
+// Describes how the key of an encrypted workspace is obtained.  Workspaces
+// without one store everything in plaintext.
+type encryptionDoc struct {
+	// "keyfile" or "scrypt" (passphrase derived)
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt,omitempty"`
+	KeyID string `json:"key_id"`
+}
+
+// Summary of a garbage collection run.  Byte counts are of the stored
+// (possibly compressed) blobs.
+type GCReport struct {
+	Filesets     int
+	Blobs        int
+	Referenced   int
+	Unreferenced int
+	TooRecent    int
+	Reclaimable  int64
+	Deleted      int
+	DeletedBytes int64
+	DanglingRefs []string
+	// This workspace's references into the shared store that no fileset
+	// needs any more, and the store's blobs no workspace references
+	StoreRefsDropped  int
+	StoreReclaimable  int64
+	StoreDeleted      int
+	StoreDeletedBytes int64
+}
+
+// A fileset FilesetSummaries looks up, and whether a summary of it was listed
+type summaryLookup struct {
 	name   string
-	bucket *s3.Bucket
+	stored bool
+}
+
+// Returned by lock when a conflicting lock is held
+type lockConflict struct {
+	what   string
+	holder string
+}
+
+// A range of a local file to be uploaded as the blob with the given digest.
+// A negative Size means the whole file.
+type Blob struct {
+	Path   string
+	Offset int64
+	Size   int64
+	Digest string
+}
+
+// The digests of the blobs under a workspace's files prefix as of a listing,
+// used to skip uploading blobs that already exist
+type inventory struct {
+	Listed time.Time `json:"listed"`
+	// The prefix that was listed
+	Prefix string `json:"prefix"`
+	// Contents of the gc marker before the listing; if it has changed since,
+	// blobs may have been deleted and the inventory can't be trusted
+	GCMarker string   `json:"gc_marker"`
+	Digests  []string `json:"digests"`
+	digests  map[string]bool
+}
+
+// Records unfinished transfers so that an interrupted push or pull picks up
+// where it stopped.  It is saved to its file after every change.
+type Journal struct {
+	path  string
+	mutex sync.Mutex
+	// Keyed by storage key
+	Uploads map[string]*journalUpload `json:"uploads"`
+	// Keyed by storage key; the raw object is fetched into a partial file
+	// next to the destination, so its size is the offset to resume from
+	Downloads map[string]*journalDownload `json:"downloads"`
+}
+
+type journalUpload struct {
+	// The metadata (compression and wrapped data key) the upload started
+	// with; resuming with anything else would produce different bytes
+	Meta  storage.Metadata    `json:"meta"`
+	State storage.UploadState `json:"state"`
+}
+
+// Identifies the version of the object being downloaded, so that a partial
+// download of an object that has since been replaced is discarded
+type journalDownload struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// A single blob to move between the local filesystem and remote storage
+type transfer struct {
+	localPath string
+	key       string
+	offset    int64
+	size      int64
+}
+
+// Throttles everything passing through it, however many goroutines are
+// involved, to rate bytes per second on average
+type rateLimiter struct {
+	rate  int64
+	mutex sync.Mutex
+	// When the bytes let through so far will have been sent at rate
+	next time.Time
+}
+
+// Wraps a reader so reads are throttled by limiter
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+// Wraps a writer so writes are throttled by limiter
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *rateLimiter
+}
+
+// Discards the first skip bytes written to it, passing the rest on to writer
+type skipWriter struct {
+	writer io.Writer
+	skip   int64
+}
+
+// Wraps a reader, adding the number of bytes read to a counter shared by all
+// concurrent transfers so that overall progress can be reported.
+type progressReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+// Turns an io.Writer into an io.WriteCloser whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
 }
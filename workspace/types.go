@@ -1,8 +1,11 @@
 package workspace
 
 import (
+	"github.com/opslabjpl/earthkit-cli/fileset"
 	"github.com/opslabjpl/earthkit-cli/workspace/remote"
 	"os"
+	"sync"
+	"time"
 )
 
 type Workspace struct {
@@ -13,3 +16,32 @@ type Workspace struct {
 }
 
 type filesDateSort []os.FileInfo
+
+// Describes a bundle, a tar archive holding a fileset manifest and blobs for
+// carrying data offline:
+//
+//	bundle.json
+//	filesets/<fileset>.json.gz
+//	files/<digest>
+//
+// Blobs are stored uncompressed and unencrypted.
+type BundleInfo struct {
+	Workspace string    `json:"workspace"`
+	Fileset   string    `json:"fileset"`
+	Base      string    `json:"base,omitempty"`
+	Created   time.Time `json:"created"`
+	Files     int       `json:"files"`
+}
+
+// Serves a fileset over HTTP as a read-only directory tree.  File contents
+// are fetched into the cache directory the first time they are requested.
+type FilesetServer struct {
+	remote   *remote.Remote
+	fileSet  *fileset.FileSet
+	cacheDir string
+	mutex    sync.Mutex
+	// Held while the file with the digest is being fetched
+	fetching map[string]*sync.Mutex
+	// Files in the cache known to match their digests
+	verified map[string]bool
+}
@@ -5,19 +5,21 @@ import (
 	"fmt"
 	"github.com/opslabjpl/earthkit-cli/config"
 	"github.com/opslabjpl/earthkit-cli/fileset"
+	"github.com/opslabjpl/earthkit-cli/storage"
 	"github.com/opslabjpl/earthkit-cli/workspace/remote"
-	"github.com/opslabjpl/goamz/s3"
-	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-// Handles init command
-func (workspace *Workspace) Init(dir string, cloning bool) {
+// Handles init command.  A new (not cloned) workspace records the given
+// description in its metadata.
+func (workspace *Workspace) Init(dir string, cloning bool, description string) {
 	// Sanity checks
 	if stat, err := os.Stat(dir); err != nil {
 		log.Fatal("No such directory: " + dir)
@@ -56,6 +58,13 @@ func (workspace *Workspace) Init(dir string, cloning bool) {
 	}
 
 	workspace.SetUpDiscoveryUrl(cloning)
+
+	if !cloning {
+		info := &remote.WorkspaceInfo{Description: description, Owner: currentAuthor(), Created: time.Now()}
+		if err := workspace.Remote().PutInfo(info); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func (workspace *Workspace) FilesetsDir() string {
@@ -63,18 +72,39 @@ func (workspace *Workspace) FilesetsDir() string {
 }
 
 // Returns the corresponding remote.Remote struct for this workspace.
+// Transfers to and from a local workspace are journaled so they can resume,
+// and the inventory of remote blobs taken by large pushes is cached there.
 func (workspace *Workspace) Remote() *remote.Remote {
 	if workspace.remote_ == nil {
-		auth := config.AWSAuth()
-		myS3 := s3.New(auth, config.Region)
-		bucket := myS3.Bucket(*config.S3_BUCKET)
-		workspace.remote_ = remote.New(workspace.Name, bucket)
+		workspace.remote_ = remote.New(workspace.Name, storage.New(), remote.DefaultLayout())
+		if workspace.LocalRootDir != "" {
+			journal, err := remote.OpenJournal(filepath.Join(workspace.LocalRootDir, EarthkitDir, "journal.json"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			workspace.remote_.SetJournal(journal)
+			workspace.remote_.SetInventoryCache(filepath.Join(workspace.LocalRootDir, EarthkitDir, "inventory.json"), *config.INVENTORY_TTL)
+		}
 	}
 	return workspace.remote_
 }
 
 // Handles push command for the given workspace and fileset
-func (workspace *Workspace) Push(filesetName string, comment string, patterns fileset.FileSetFilter) {
+// Pushes the working tree as a new fileset.  Unless force is set, an existing
+// fileset is never overwritten, and the push is refused if another fileset has
+// been pushed since the one this workspace is based on; with rebase, our
+// changes are instead merged onto that fileset, which is then pulled.
+func (workspace *Workspace) Push(filesetName string, comment string, patterns fileset.FileSetFilter, force bool, rebase bool) {
+	remoteWs := workspace.Remote()
+	// Both checks are made again just before publishing, under a lock, as
+	// another push may have got in while we were building or uploading
+	checkNew := refuseExisting(remoteWs, filesetName, "Choose another name, or push with -f to overwrite it.")
+	if !force {
+		if err := checkNew(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	cache_exists := true
 	var cachedFileSet *fileset.FileSet
 	mdata, err := ioutil.ReadFile(filepath.Join(workspace.FilesetsDir(), "_current"))
@@ -93,32 +123,104 @@ func (workspace *Workspace) Push(filesetName string, comment string, patterns fi
 	}
 
 	baseDir := workspace.LocalRootDir
-	builderCfg := fileset.BuilderCfg{baseDir, false, true, []string{EarthkitDir}}
+	builderCfg := fileset.BuilderCfg{baseDir, false, true, workspace.IgnorePatterns()}
 	result := fileset.Build(builderCfg, cachedFileSet, patterns)
 
 	fileSet := result.FileSet()
 	fileSet.Comment = comment
+	if cache_exists {
+		fileSet.Parent = workspace.GetCurrentFileSetName()
+	}
+	fileSet.Author = currentAuthor()
+	fileSet.Host, _ = os.Hostname()
+	if *config.CHUNKING {
+		chunkFiles(baseDir, fileSet)
+	}
 	digestMap := fileSet.Root.DigestMap()
 
-	files := make(map[string]string)
+	// Chunked files are uploaded chunk by chunk, everything else whole
+	blobs := make([]remote.Blob, 0, len(digestMap))
+	seen := make(map[string]bool)
 	for digest, entries := range digestMap {
 		fileName := filepath.Join(baseDir, entries[0].Path)
-		files[fileName] = digest
+		chunks := entries[0].Entry.Chunks
+		if len(chunks) == 0 {
+			if !seen[digest] {
+				seen[digest] = true
+				blobs = append(blobs, remote.Blob{Path: fileName, Offset: 0, Size: -1, Digest: digest})
+			}
+			continue
+		}
+		offset := int64(0)
+		for _, chunk := range chunks {
+			if !seen[chunk.Digest] {
+				seen[chunk.Digest] = true
+				blobs = append(blobs, remote.Blob{Path: fileName, Offset: offset, Size: chunk.Size, Digest: chunk.Digest})
+			}
+			offset += chunk.Size
+		}
 	}
 
-	remoteWs := workspace.Remote()
-	remoteWs.Upload(files)
+	// Check for concurrent pushes only now that the (possibly slow) build is
+	// done, to keep the window for a race small
+	rebased := false
+	expectedLatest := ""
+	if cache_exists && !force {
+		base := workspace.GetCurrentFileSetName()
+		expectedLatest = base
+		latest, err := remoteWs.LatestFileset()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if latest != "" && latest != base {
+			if !rebase {
+				fmt.Printf("Fileset %s has been pushed since %s, which this workspace is based on.\n", latest, base)
+				fmt.Println("Push with -rebase to apply your changes on top of it, or with -f to push anyway.")
+				os.Exit(1)
+			}
+			merged, conflicts := fileset.Merge(cachedFileSet, fileSet, remoteWs.GetFileset(latest))
+			if len(conflicts) > 0 {
+				fmt.Printf("Unable to rebase onto %s; these paths were changed on both sides:\n", latest)
+				for _, path := range conflicts {
+					fmt.Println("  " + path)
+				}
+				os.Exit(1)
+			}
+			fmt.Printf("Rebasing onto %s\n", latest)
+			merged.Parent = latest
+			fileSet = merged
+			rebased = true
+			expectedLatest = latest
+		}
+	}
 
-	// upload the fileset json
 	data, err := fileSet.GzJson()
 	if err != nil {
 		panic(err)
 	}
-	filesetName = filesetName + ".json.gz"
-	err = remoteWs.PutFileset(filesetName, data)
-	if err != nil {
-		panic(err)
+	check := func() error {
+		if force {
+			return nil
+		}
+		if err := checkNew(); err != nil {
+			return err
+		}
+		if !cache_exists {
+			return nil
+		}
+		latest, err := remoteWs.LatestFileset()
+		if err != nil {
+			return err
+		}
+		if latest != "" && latest != expectedLatest {
+			return fmt.Errorf("Fileset %s was pushed while this push was uploading. Push again with -rebase to apply your changes on top of it, or with -f to push anyway.", latest)
+		}
+		return nil
+	}
+	if err = uploadFileset(remoteWs, filesetName, fileSet, data, blobs, check); err != nil {
+		log.Fatal(err)
 	}
+	filesetName = filesetName + ".json.gz"
 	err = workspace.cacheFileset(filesetName, data)
 	if err != nil {
 		log.Fatal(err)
@@ -127,11 +229,22 @@ func (workspace *Workspace) Push(filesetName string, comment string, patterns fi
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Bring in the changes we rebased onto
+	if rebased {
+		workspace.Pull(fileset.FileSetNameFromFile(filesetName), workspace.patternCache_)
+	}
 }
 
 func (workspace *Workspace) Pull(filesetName string, patterns fileset.FileSetFilter) {
+	// filesetName may be a ref, in which case we pull the fileset it points at
+	filesetName, err := workspace.Remote().ResolveFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// generate local fileset (without calculating checksum)
-	builderCfg := fileset.BuilderCfg{workspace.LocalRootDir, false, false, []string{EarthkitDir}}
+	builderCfg := fileset.BuilderCfg{workspace.LocalRootDir, false, false, workspace.IgnorePatterns()}
 	buildRes := fileset.Build(builderCfg, nil, nil)
 	localFileSet := buildRes.FileSet()
 	localEntryMap := localFileSet.Root.Flatten()
@@ -174,23 +287,11 @@ func (workspace *Workspace) Pull(filesetName string, patterns fileset.FileSetFil
 		workspace.UpdatePatternCache(patterns)
 	}
 
-	// Now get the fileset from S3
-	auth := config.AWSAuth()
-	myS3 := s3.New(auth, config.Region)
-	bucket := myS3.Bucket(*config.S3_BUCKET)
-	s3Prefix := config.WorkspacePrefix(workspace.Name)
-
+	// Now get the fileset from remote storage
 	filesetGzFile := filesetName + ".json.gz"
-	path := s3Prefix + "/filesets/" + filesetGzFile
-
-	exists, _ := bucket.Exists(path)
-	if !exists {
-		log.Fatal("Fileset " + filesetName + " does not exist.")
-	}
-
-	data, err = bucket.Get(path)
+	data, err = workspace.Remote().GetFilesetData(filesetName)
 	if err != nil {
-		log.Fatal("Unable to fetch fileset")
+		log.Fatal(err)
 	}
 	remoteFileSet, err := fileset.LoadGzJson(data)
 	if err != nil {
@@ -236,17 +337,10 @@ func (workspace *Workspace) Filter(remoteEntryMap fileset.EntryMap, patterns []s
 	}
 
 	filteredEntryMap := make(fileset.EntryMap)
+	filter := fileset.NewPathFilter(patterns)
 
-	for k, _ := range remoteEntryMap {
-		match := false
-		for _, pattern := range patterns {
-			this_match, _ := filepath.Match(pattern, k)
-			if this_match {
-				match = true
-			}
-		}
-
-		if match {
+	for k, v := range remoteEntryMap {
+		if filter.Match(k, v.Mode.IsDir()) {
 			// we need to back-add all the parent directories
 			// as well as the target entry
 			dirs := strings.Split(k, string(filepath.Separator))
@@ -274,115 +368,162 @@ func (workspace *Workspace) SelectiveWipe(remoteEntryMap fileset.EntryMap) {
 	}
 }
 
-// wipe out everything
+// wipe out everything but the .earthkit directory and ignored files
 func (workspace *Workspace) Wipe() {
-	earthkitPath := filepath.Join(workspace.LocalRootDir)
-	file, err := os.Open(earthkitPath)
-	if err != nil {
-		log.Fatal(err)
+	wipe(workspace.LocalRootDir, "", fileset.ParseIgnoreRules(workspace.IgnorePatterns()))
+}
+
+// Returns the patterns of paths left out of filesets: the .earthkit
+// directory, then those in the user's ignore file, then those in the
+// workspace's, so that the workspace's take precedence
+func (workspace *Workspace) IgnorePatterns() []string {
+	patterns := []string{EarthkitDir}
+	globalFile := *config.IGNORE_FILE
+	if globalFile == "" {
+		globalFile = filepath.Join(os.Getenv("HOME"), IgnoreFile)
 	}
-	defer file.Close()
-	for filenames, err := file.Readdir(1000); err == nil; filenames, err = file.Readdir(1000) {
-		for _, fileStat := range filenames {
-			if fileStat.Name() == EarthkitDir {
-				continue
-			} else {
-				os.RemoveAll(filepath.Join(workspace.LocalRootDir, fileStat.Name()))
-			}
+	for _, path := range []string{globalFile, filepath.Join(workspace.LocalRootDir, IgnoreFile)} {
+		lines, err := fileset.ReadIgnoreFile(path)
+		if err != nil {
+			log.Fatal(err)
 		}
+		patterns = append(patterns, lines...)
 	}
-	if err != nil && err != io.EOF {
-		log.Fatal(err)
-	}
+	// Nothing can bring back the .earthkit directory
+	return append(patterns, "/"+EarthkitDir+"/")
 }
 
 func (workspace *Workspace) Rebuild(entryMap fileset.EntryMap) {
-	cacheDir := filepath.Join(workspace.LocalRootDir, EarthkitDir, "cache")
+	rebuild(workspace.LocalRootDir, workspace.cacheDir(), entryMap)
+}
 
-	// This map is used for keeping track of digest file that has been moved
-	// from cache to final workspace
-	movedDigestMap := make(map[string]string)
-
-	// Need to sort the entries since we need to create parent dirs first before
-	// creating children entries
-	keys := make([]string, len(entryMap))
-	i := 0
-	for k, _ := range entryMap {
-		keys[i] = k
-		i++
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		path := filepath.Join(workspace.LocalRootDir, k)
-		entry := entryMap[k]
-		// fmt.Println("creating", path, "for entry", entry)
-		if entry.Mode.IsDir() {
-			os.MkdirAll(path, entry.Mode)
-		} else if entry.Target != "" {
-			os.Symlink(entry.Target, path)
-		} else {
-			srcFile := filepath.Join(cacheDir, entry.Digest)
-
-			// empty file. Just create
-			if entry.Size == 0 {
-				os.Create(path)
-				// if src file doesn't exist, it's because we already
-				// move it for another file. Let's just copy it then
-			} else if _, err := os.Stat(srcFile); os.IsNotExist(err) {
-				cp(movedDigestMap[srcFile], path)
-			} else {
-				os.Rename(srcFile, path)
-				movedDigestMap[srcFile] = path
+// Writes the fileset's entries, optionally filtered by patterns, into dir as
+// a pull would, but with nothing else: no .earthkit directory, cache or
+// discovery URL.  dir must be empty if it exists.  Files in this workspace's
+// cache, if it has one, are copied from there and the rest are downloaded.
+func (workspace *Workspace) Export(filesetName string, patterns []string, dir string) {
+	remoteWs := workspace.Remote()
+	filesetName, err := remoteWs.ResolveFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := remoteWs.GetFilesetData(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileSet, err := fileset.LoadGzJson(data)
+	if err != nil {
+		log.Fatalf("Unable to parse fileset %s: %s", filesetName, err)
+	}
+	entryMap := workspace.Filter(fileSet.Root.Flatten(), patterns)
+
+	if infos, err := ioutil.ReadDir(dir); err == nil && len(infos) > 0 {
+		log.Fatalf("%s is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	// Contents are staged beside dir, on the same filesystem, so they can be
+	// moved into place
+	absDir, _ := filepath.Abs(dir)
+	cacheDir, err := ioutil.TempDir(filepath.Dir(absDir), "."+filepath.Base(absDir)+".export")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	if workspace.LocalRootDir != "" {
+		for _, entry := range entryMap {
+			if entry.Digest == "" {
+				continue
+			}
+			staged := filepath.Join(cacheDir, entry.Digest)
+			if _, err := os.Stat(staged); err == nil {
+				continue
+			}
+			if err := cp(filepath.Join(workspace.cacheDir(), entry.Digest), staged); err != nil {
+				os.Remove(staged)
 			}
 		}
-		os.Chmod(path, entry.Mode)
 	}
+	fetchDigests(remoteWs, cacheDir, entryMap)
+	rebuild(dir, cacheDir, entryMap)
+	fmt.Printf("Exported fileset %s to %s\n", filesetName, dir)
+}
 
-	// Have to set mtime here at the end and not
-	// in the loop above because creating entries will undesirely update the
-	// parent dirs' mtime and atime
-	for k, entry := range entryMap {
-		path := filepath.Join(workspace.LocalRootDir, k)
-		if !entry.Mode.IsRegular() {
-			continue
-		}
-		err := os.Chtimes(path, entry.ModTime, entry.ModTime)
-		if err != nil {
-			fmt.Println(err.Error())
+// Serves the fileset over HTTP on addr until the process is killed.  Files
+// are fetched into cacheDir on demand, which defaults to this workspace's
+// cache or, outside a workspace, to a directory under the system's temporary
+// directory that later runs reuse.
+func (workspace *Workspace) Serve(filesetName string, addr string, cacheDir string) {
+	remoteWs := workspace.Remote()
+	filesetName, err := remoteWs.ResolveFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileSet := remoteWs.GetFileset(filesetName)
+	if cacheDir == "" {
+		if workspace.LocalRootDir != "" {
+			cacheDir = workspace.cacheDir()
+		} else {
+			// Not a shared temporary directory, where others could plant files
+			cacheDir = filepath.Join(os.Getenv("HOME"), EarthkitDir, "serve", workspace.Name)
 		}
 	}
+	if err = os.MkdirAll(cacheDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Serving fileset %s at http://%s/\n", filesetName, addr)
+	log.Fatal(http.ListenAndServe(addr, NewFilesetServer(remoteWs, fileSet, cacheDir)))
 }
 
-func (workspace *Workspace) DownloadNewDigests(remoteEntryMap fileset.EntryMap) {
-	cacheDir := filepath.Join(workspace.LocalRootDir, EarthkitDir, "cache")
-	if _, err := os.Stat(cacheDir); err != nil {
-		os.MkdirAll(cacheDir, 0700)
+// Compares two remote filesets (or refs) by content or, if newName is empty,
+// a remote fileset and the working tree
+func (workspace *Workspace) DiffFilesets(oldName string, newName string) *fileset.FileSetDiff {
+	remoteWs := workspace.Remote()
+	oldName, err := remoteWs.ResolveFileset(oldName)
+	if err != nil {
+		log.Fatal(err)
 	}
+	oldMap := remoteWs.GetFileset(oldName).Root.Flatten()
 
-	// Get list of digest to download
-	digestSet := make(map[string]bool)
-	for _, entry := range remoteEntryMap {
-		if entry.Digest == "" {
-			continue
+	var newMap fileset.EntryMap
+	if newName != "" {
+		if newName, err = remoteWs.ResolveFileset(newName); err != nil {
+			log.Fatal(err)
 		}
-		if _, err := os.Stat(filepath.Join(cacheDir, entry.Digest)); err != nil {
-			if os.IsNotExist(err) {
-				digestSet[entry.Digest] = true
-			} else {
+		newMap = remoteWs.GetFileset(newName).Root.Flatten()
+	} else {
+		if workspace.LocalRootDir == "" {
+			log.Fatal("Diffing against the working tree requires being in a workspace")
+		}
+		// Digests of unchanged files are taken from the current fileset
+		var cachedFileSet *fileset.FileSet
+		if data, err := ioutil.ReadFile(filepath.Join(workspace.FilesetsDir(), "_current")); err == nil {
+			if cachedFileSet, err = fileset.LoadGzJson(data); err != nil {
 				log.Fatal(err)
 			}
 		}
+		builderCfg := fileset.BuilderCfg{workspace.LocalRootDir, false, true, workspace.IgnorePatterns()}
+		newMap = fileset.Build(builderCfg, cachedFileSet, nil).FileSet().Root.Flatten()
 	}
-	// Convert the set to a flat array
-	digests := make([]string, len(digestSet))
-	i := 0
-	for digest, _ := range digestSet {
-		digests[i] = digest
-		i++
+	return fileset.DiffFileSets(oldMap, newMap)
+}
+
+func (workspace *Workspace) DownloadNewDigests(remoteEntryMap fileset.EntryMap) {
+	fetchDigests(workspace.Remote(), workspace.cacheDir(), remoteEntryMap)
+}
+
+// Concatenates the cached chunks of each file into a cached file named after
+// the file's digest, verifying the result against that digest.
+func assembleChunks(cacheDir string, chunked map[string][]fileset.Chunk) {
+	for fileDigest, chunks := range chunked {
+		if err := assembleFile(cacheDir, fileDigest, chunks); err != nil {
+			log.Fatal(err)
+		}
 	}
-	// download the needed digests files
-	fmt.Println(digests)
-	workspace.Remote().Download(cacheDir, digests)
 }
 
 func (workspace *Workspace) Cache(localEntryMap fileset.EntryMap, cachedEntryMap fileset.EntryMap, diff fileset.EntryMapDiff) {
@@ -498,52 +639,375 @@ func (workspace *Workspace) ClearPatternCache() {
 	os.Remove(patternCachePath)
 }
 
-// Does not handle race conditions. Only here as a helper function for
-// cleaning up workspaces while doing development
+// Deletes a fileset's manifest.  The blobs it referenced are left in place;
+// run gc to reclaim the ones no other fileset uses.
 func (workspace *Workspace) DeleteFileset(filesetName string) {
-	filesPrefix := workspace.Remote().FilesPrefix()
-	filesetToDelete := workspace.Remote().GetFileset(filesetName)
-	filesetKeyToDelete := workspace.Remote().FilesetsPrefix() + filesetName + ".json.gz"
-
-	// Map of all digests for this workspace. Entries map to 1 will be delete. Entries
-	// map to 0 will be skip (e.g. digests that are still referenced by other filesets)
-	var digests = make(map[string]int)
+	remoteWs := workspace.Remote()
 
-	digestMap := filesetToDelete.Root.DigestMap()
-	for digest, _ := range digestMap {
-		digests[digest] = 1
+	// Refuse to leave refs dangling
+	refs, err := remoteWs.Refs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for ref, target := range refs {
+		if target == filesetName {
+			log.Fatalf("Fileset %s is referenced by ref %s. Move or delete the ref first.", filesetName, ref)
+		}
+	}
+	if _, err := remoteWs.GetFilesetData(filesetName); err != nil {
+		log.Fatalf("Unable to find fileset %s: %s", filesetName, err)
+	}
+	err = remoteWs.DeleteFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
 	}
+}
+
+// Checks that every file in the local cache, and every remote blob needed by
+// the given fileset (if any), hashes to its name.  Remote blobs that no
+// fileset references are reported as orphans.  With repair, corrupt cache
+// files are replaced from the remote (or just dropped, to be fetched again on
+// pull) and missing or corrupt remote blobs are re-uploaded from a local copy
+// that checks out.  Returns the number of problems left unrepaired.
+func (workspace *Workspace) Verify(filesetName string, repair bool) (problems int) {
+	remoteWs := workspace.Remote()
+	cacheDir := workspace.cacheDir()
 
-	println("Determining what to delete...")
+	fmt.Println("Verifying local cache...")
+	infos, err := ioutil.ReadDir(cacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	var redownload []string
+	for _, info := range infos {
+		// Skip anything that isn't named after a digest, such as partial
+		// downloads
+		if !info.Mode().IsRegular() || strings.Contains(info.Name(), ".") {
+			continue
+		}
+		digest := info.Name()
+		cachePath := filepath.Join(cacheDir, digest)
+		actual, err := hashSection(cachePath, 0, -1)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if actual == digest {
+			continue
+		}
+		fmt.Printf("corrupt  cache/%s (content hashes to %s)\n", digest, actual)
+		if !repair {
+			problems++
+			continue
+		}
+		if err := os.Remove(cachePath); err != nil {
+			log.Fatal(err)
+		}
+		if found, err := remoteWs.VerifyFile(digest); found && err == nil {
+			redownload = append(redownload, digest)
+		} else {
+			fmt.Printf("removed  cache/%s\n", digest)
+		}
+	}
+	if len(redownload) > 0 {
+		remoteWs.Download(cacheDir, redownload)
+		for _, digest := range redownload {
+			fmt.Printf("repaired cache/%s\n", digest)
+		}
+	}
+	fmt.Printf("Checked %d cached files\n", len(infos))
 
-	// Get all filesets
-	filesetKeys, _ := workspace.Remote().Filesets()
-	auth := config.AWSAuth()
-	myS3 := s3.New(auth, config.Region)
-	bucket := myS3.Bucket(*config.S3_BUCKET)
+	if filesetName == "" {
+		return
+	}
+	filesetName, err = remoteWs.ResolveFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileSet := remoteWs.GetFileset(filesetName)
+	fmt.Printf("Verifying remote files of fileset %s...\n", filesetName)
+	sources := workspace.localSources(fileSet)
 
-	for _, key := range filesetKeys {
-		if key.Key == filesetKeyToDelete {
+	var reupload []remote.Blob
+	blobs := fileSet.Root.BlobDigests()
+	for digest, _ := range blobs {
+		found, err := remoteWs.VerifyFile(digest)
+		if found && err == nil {
 			continue
 		}
-		data, err := bucket.Get(key.Key)
+		key, keyErr := remoteWs.BlobKey(digest)
+		if keyErr != nil {
+			log.Fatal(keyErr)
+		}
+		if found {
+			fmt.Printf("corrupt  %s (%s)\n", key, err)
+		} else {
+			fmt.Printf("missing  %s\n", key)
+		}
+		if !repair {
+			problems++
+			continue
+		}
+		source := goodSource(sources[digest])
+		if source == nil {
+			fmt.Printf("No good local copy of %s to repair it from\n", digest)
+			problems++
+			continue
+		}
+		if found {
+			if err := remoteWs.DeleteFile(digest); err != nil {
+				log.Fatal(err)
+			}
+		}
+		reupload = append(reupload, *source)
+	}
+	if len(reupload) > 0 {
+		release, err := remoteWs.Lock("push")
 		if err != nil {
-			log.Fatal("Unable to fetch fileset")
+			log.Fatal(err)
+		}
+		err = remoteWs.UploadBlobs(reupload)
+		release()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, blob := range reupload {
+			key, err := remoteWs.BlobKey(blob.Digest)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("repaired %s\n", key)
+		}
+	}
+	fmt.Printf("Checked %d remote files\n", len(blobs))
+
+	report, err := remoteWs.GC(0, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if report.Unreferenced > 0 {
+		fmt.Printf("%d remote files (%d bytes) are orphaned, referenced by no fileset; run gc to delete them\n", report.Unreferenced, report.Reclaimable)
+	}
+	return
+}
+
+// Returns the local copies each blob of the fileset could be read from: the
+// cached file or the file in the working tree, or the right section of either
+// for chunks.  They may since have changed; see goodSource.
+func (workspace *Workspace) localSources(fileSet *fileset.FileSet) map[string][]remote.Blob {
+	cacheDir := workspace.cacheDir()
+	sources := make(map[string][]remote.Blob)
+	for digest, entries := range fileSet.Root.DigestMap() {
+		paths := []string{filepath.Join(cacheDir, digest)}
+		for _, entryPath := range entries {
+			paths = append(paths, filepath.Join(workspace.LocalRootDir, entryPath.Path))
 		}
-		remoteFileSet, err := fileset.LoadGzJson(data)
-		digestMap := remoteFileSet.Root.DigestMap()
-		for digest, _ := range digestMap {
-			digests[digest] = 0
+		chunks := entries[0].Entry.Chunks
+		for _, path := range paths {
+			if len(chunks) == 0 {
+				sources[digest] = append(sources[digest], remote.Blob{Path: path, Offset: 0, Size: -1, Digest: digest})
+				continue
+			}
+			offset := int64(0)
+			for _, chunk := range chunks {
+				sources[chunk.Digest] = append(sources[chunk.Digest], remote.Blob{Path: path, Offset: offset, Size: chunk.Size, Digest: chunk.Digest})
+				offset += chunk.Size
+			}
 		}
 	}
+	return sources
+}
 
-	for digest, deleteOrNot := range digests {
-		if deleteOrNot == 1 {
-			bucket.Del(filesPrefix + digest)
-			println("Deleting", filesPrefix+digest)
+// Writes a bundle holding the fileset's manifest and every blob it needs to
+// bundlePath, for carrying to places remote storage can't be reached from.
+// With a base fileset, blobs the base also needs are left out, so the bundle
+// can only be imported where the base already is.  Blobs are read from the
+// cache or working tree where they are intact, and downloaded otherwise.
+func (workspace *Workspace) CreateBundle(filesetName string, baseName string, bundlePath string) {
+	remoteWs := workspace.Remote()
+	filesetName, err := remoteWs.ResolveFileset(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := remoteWs.GetFilesetData(filesetName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileSet, err := fileset.LoadGzJson(data)
+	if err != nil {
+		log.Fatalf("Unable to parse fileset %s: %s", filesetName, err)
+	}
+
+	needed := fileSet.Root.BlobDigests()
+	if baseName != "" {
+		if baseName, err = remoteWs.ResolveFileset(baseName); err != nil {
+			log.Fatal(err)
+		}
+		for digest, _ := range remoteWs.GetFileset(baseName).Root.BlobDigests() {
+			delete(needed, digest)
+		}
+	}
+
+	// Anything without a good local copy is downloaded first
+	sources := workspace.localSources(fileSet)
+	blobs := make(map[string]remote.Blob, len(needed))
+	var missing []string
+	for digest, _ := range needed {
+		if source := goodSource(sources[digest]); source != nil {
+			blobs[digest] = *source
+		} else {
+			missing = append(missing, digest)
+		}
+	}
+	if len(missing) > 0 {
+		tmpDir, err := ioutil.TempDir(filepath.Join(workspace.LocalRootDir, EarthkitDir), "bundle")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		fmt.Printf("Downloading %d files not available locally\n", len(missing))
+		remoteWs.Download(tmpDir, missing)
+		for _, digest := range missing {
+			blobs[digest] = remote.Blob{Path: filepath.Join(tmpDir, digest), Offset: 0, Size: -1, Digest: digest}
+		}
+	}
+
+	info := BundleInfo{
+		Workspace: workspace.Name,
+		Fileset:   filesetName,
+		Base:      baseName,
+		Created:   time.Now(),
+		Files:     len(blobs),
+	}
+	tmp := bundlePath + partialSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeBundle(f, &info, data, blobs); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, bundlePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote fileset %s and %d files to %s\n", filesetName, len(blobs), bundlePath)
+}
+
+// Loads a bundle written by CreateBundle into the local cache and/or remote
+// storage.  Every blob is checked against its digest as it is read.  A
+// fileset is only written to remote storage once every blob it needs is
+// there; when loading into the cache, its files are reassembled from their
+// chunks where possible.
+func (workspace *Workspace) ImportBundle(bundlePath string, toCache bool, toRemote bool, force bool) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	tmpDir, err := ioutil.TempDir(filepath.Join(workspace.LocalRootDir, EarthkitDir), "bundle")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	info, data, digests, err := readBundle(f, tmpDir)
+	if err != nil {
+		log.Fatalf("Unable to read bundle %s: %s", bundlePath, err)
+	}
+	fileSet, err := fileset.LoadGzJson(data)
+	if err != nil {
+		log.Fatalf("Unable to parse fileset %s: %s", info.Fileset, err)
+	}
+	fmt.Printf("Bundle of fileset %s from workspace %s holds %d files\n", info.Fileset, info.Workspace, len(digests))
+	bundled := make(map[string]bool, len(digests))
+	for _, digest := range digests {
+		bundled[digest] = true
+	}
+
+	if toRemote {
+		remoteWs := workspace.Remote()
+		var check func() error
+		if !force {
+			check = refuseExisting(remoteWs, info.Fileset, "Import with -f to overwrite it.")
+			if err = check(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for digest, _ := range fileSet.Root.BlobDigests() {
+			if bundled[digest] {
+				continue
+			}
+			exists, err := remoteWs.FileExists(digest)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !exists {
+				log.Fatalf("File %s is in neither the bundle nor the workspace; import its base fileset %s first", digest, info.Base)
+			}
+		}
+		blobs := make([]remote.Blob, 0, len(digests))
+		for _, digest := range digests {
+			blobs = append(blobs, remote.Blob{Path: filepath.Join(tmpDir, digest), Offset: 0, Size: -1, Digest: digest})
+		}
+		if err = uploadFileset(remoteWs, info.Fileset, fileSet, data, blobs, check); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Imported fileset %s into workspace %s\n", info.Fileset, remoteWs.Name())
+	}
+
+	if toCache {
+		cacheDir := workspace.cacheDir()
+		if err = os.MkdirAll(cacheDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		for _, digest := range digests {
+			if err = os.Rename(filepath.Join(tmpDir, digest), filepath.Join(cacheDir, digest)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// The cache holds whole files, so chunks are only kept until their
+		// files have been assembled
+		chunked := make(map[string][]fileset.Chunk)
+		whole := make(map[string]bool)
+		incomplete := 0
+		for _, entry := range fileSet.Root.Flatten() {
+			if len(entry.Chunks) == 0 {
+				whole[entry.Digest] = true
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(cacheDir, entry.Digest)); err == nil {
+				continue
+			}
+			complete := true
+			for _, chunk := range entry.Chunks {
+				if _, err := os.Stat(filepath.Join(cacheDir, chunk.Digest)); err != nil {
+					complete = false
+				}
+			}
+			if complete {
+				chunked[entry.Digest] = entry.Chunks
+			} else {
+				incomplete++
+			}
+		}
+		assembleChunks(cacheDir, chunked)
+		for _, digest := range digests {
+			if !whole[digest] {
+				os.Remove(filepath.Join(cacheDir, digest))
+			}
+		}
+		if err = workspace.cacheFileset(info.Fileset+".json.gz", data); err != nil {
+			log.Fatal(err)
+		}
+		if incomplete > 0 {
+			fmt.Printf("%d chunked files could not be assembled for lack of chunks from the base fileset\n", incomplete)
 		}
+		fmt.Printf("Loaded fileset %s into the local cache\n", info.Fileset)
 	}
-	bucket.Del(filesetKeyToDelete)
 }
 
 func (workspace *Workspace) cleanCache(cacheLimit int64) {